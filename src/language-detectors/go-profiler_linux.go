@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Memory limit files for cgroup v2 and v1, as mounted inside a container
+const (
+	cgroupV2MemoryMax   = "/sys/fs/cgroup/memory.max"
+	cgroupV1MemoryLimit = "/sys/fs/cgroup/memory/memory.limit_in_bytes"
+)
+
+// cgroupV1Unlimited is the smallest memory.limit_in_bytes treated as no
+// limit. cgroup v1 reports an unlimited group as the largest page-aligned
+// int64.
+const cgroupV1Unlimited = 1 << 62
+
+// ProcessRSS returns the resident set size of the current process as seen by
+// the OS, read from /proc/self/statm
+func ProcessRSS() (uint64, error) {
+	f, err := os.Open("/proc/self/statm")
+	if err != nil {
+		return 0, fmt.Errorf("open statm: %w", err)
+	}
+	defer f.Close()
+
+	return parseStatmRSS(f, os.Getpagesize())
+}
+
+// parseStatmRSS reads the resident page count, the second field of
+// /proc/<pid>/statm, and converts it to bytes
+func parseStatmRSS(r io.Reader, pageSize int) (uint64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, fmt.Errorf("read statm: %w", err)
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("malformed statm: %q", data)
+	}
+
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse statm resident pages: %w", err)
+	}
+	return pages * uint64(pageSize), nil
+}
+
+// CgroupMemoryLimit returns the memory limit of the process's cgroup, read
+// from cgroup v2's memory.max or, failing that, cgroup v1's
+// memory.limit_in_bytes. It returns ErrNoMemoryLimit when the cgroup is
+// unconstrained.
+func CgroupMemoryLimit() (uint64, error) {
+	return cgroupMemoryLimit(os.ReadFile)
+}
+
+// cgroupMemoryLimit implements CgroupMemoryLimit with an injectable file
+// reader
+func cgroupMemoryLimit(readFile func(string) ([]byte, error)) (uint64, error) {
+	if data, err := readFile(cgroupV2MemoryMax); err == nil {
+		value := strings.TrimSpace(string(data))
+		if value == "max" {
+			return 0, ErrNoMemoryLimit
+		}
+		limit, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parse memory.max: %w", err)
+		}
+		return limit, nil
+	}
+
+	data, err := readFile(cgroupV1MemoryLimit)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, ErrNoMemoryLimit
+		}
+		return 0, fmt.Errorf("read memory.limit_in_bytes: %w", err)
+	}
+	limit, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse memory.limit_in_bytes: %w", err)
+	}
+	if limit >= cgroupV1Unlimited {
+		return 0, ErrNoMemoryLimit
+	}
+	return limit, nil
+}
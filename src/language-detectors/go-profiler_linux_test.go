@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseStatmRSS(t *testing.T) {
+	// size resident shared text lib data dt
+	rss, err := parseStatmRSS(strings.NewReader("183114 2456 1316 346 0 30838 0\n"), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rss != 2456*4096 {
+		t.Fatalf("expected %d bytes, got %d", 2456*4096, rss)
+	}
+
+	for _, input := range []string{"", "183114", "183114 lots 1316"} {
+		if _, err := parseStatmRSS(strings.NewReader(input), 4096); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestProcessRSS(t *testing.T) {
+	rss, err := ProcessRSS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rss == 0 {
+		t.Fatal("expected non-zero RSS")
+	}
+
+	p := NewGoMemoryProfiler(100)
+	if stats := p.GetMemoryStats(); stats.ProcessRSS == 0 {
+		t.Fatal("expected MemoryStats to include process RSS")
+	}
+}
+
+// fakeCgroupFiles returns a file reader serving files from contents
+func fakeCgroupFiles(contents map[string]string) func(string) ([]byte, error) {
+	return func(path string) ([]byte, error) {
+		data, ok := contents[path]
+		if !ok {
+			return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+		}
+		return []byte(data), nil
+	}
+}
+
+func TestCgroupMemoryLimit(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  uint64
+		err   error
+	}{
+		{"v2 limit", map[string]string{cgroupV2MemoryMax: "536870912\n"}, 512 << 20, nil},
+		{"v2 unlimited", map[string]string{cgroupV2MemoryMax: "max\n"}, 0, ErrNoMemoryLimit},
+		{"v1 limit", map[string]string{cgroupV1MemoryLimit: "268435456\n"}, 256 << 20, nil},
+		{"v1 unlimited", map[string]string{cgroupV1MemoryLimit: "9223372036854771712\n"}, 0, ErrNoMemoryLimit},
+		{"no cgroup", map[string]string{}, 0, ErrNoMemoryLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit, err := cgroupMemoryLimit(fakeCgroupFiles(tt.files))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if limit != tt.want {
+				t.Fatalf("expected limit %d, got %d", tt.want, limit)
+			}
+		})
+	}
+
+	if _, err := cgroupMemoryLimit(fakeCgroupFiles(map[string]string{cgroupV2MemoryMax: "lots"})); err == nil {
+		t.Fatal("expected error for malformed memory.max")
+	}
+}
+
+func TestMemoryUtilization(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	limit, err := CgroupMemoryLimit()
+	if errors.Is(err, ErrNoMemoryLimit) {
+		if _, err := p.MemoryUtilization(); !errors.Is(err, ErrNoMemoryLimit) {
+			t.Fatalf("expected ErrNoMemoryLimit outside a constrained cgroup, got %v", err)
+		}
+		t.Skip("not running under a cgroup memory limit")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	utilization, err := p.MemoryUtilization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if utilization <= 0 {
+		t.Fatalf("expected positive utilization of a %d byte limit, got %v", limit, utilization)
+	}
+}
+
+func TestInstallSignalHandler(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "snapshots")
+	p := NewGoMemoryProfiler(100)
+	if err := p.InstallSignalHandler(syscall.SIGUSR1, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+
+	var stats, heap []string
+	deadline := time.Now().Add(5 * time.Second)
+	for (len(stats) == 0 || len(heap) == 0) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		stats, _ = filepath.Glob(filepath.Join(dir, "memstats-*.json"))
+		heap, _ = filepath.Glob(filepath.Join(dir, "heap-*.pprof"))
+	}
+	p.RemoveSignalHandler(syscall.SIGUSR1)
+
+	if len(stats) != 1 || len(heap) != 1 {
+		t.Fatalf("expected one stats file and one heap profile, got %v and %v", stats, heap)
+	}
+	assertPprofFile(t, heap[0])
+
+	if p.signalHandlers[syscall.SIGUSR1] != nil {
+		t.Fatal("expected the handler to be removed")
+	}
+}
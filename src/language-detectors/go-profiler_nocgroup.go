@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// CgroupMemoryLimit is only implemented on Linux
+func CgroupMemoryLimit() (uint64, error) {
+	return 0, fmt.Errorf("%w: cgroups not supported on %s", ErrNoMemoryLimit, runtime.GOOS)
+}
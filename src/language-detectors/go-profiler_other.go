@@ -0,0 +1,13 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// ProcessRSS is not implemented on this platform
+func ProcessRSS() (uint64, error) {
+	return 0, fmt.Errorf("process RSS not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,3598 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStartSampling(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	p.StartSampling(10 * time.Millisecond)
+	time.Sleep(120 * time.Millisecond)
+	p.StopSampling()
+
+	p.mu.Lock()
+	count := len(p.samples)
+	p.mu.Unlock()
+
+	if count < 10 || count > 13 {
+		t.Fatalf("expected 10-13 samples, got %d", count)
+	}
+
+	// No further samples once stopped
+	time.Sleep(30 * time.Millisecond)
+	p.mu.Lock()
+	after := len(p.samples)
+	p.mu.Unlock()
+	if after != count {
+		t.Fatalf("sampling continued after stop: %d -> %d", count, after)
+	}
+}
+
+func TestPauseResumeSampling(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	p.StartSampling(5 * time.Millisecond)
+	defer p.StopSampling()
+
+	waitForSamples := func(n int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for len(p.Samples()) < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected at least %d samples, got %d", n, len(p.Samples()))
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitForSamples(3)
+
+	p.Pause()
+	if !p.Paused() {
+		t.Fatal("expected the sampler to report paused")
+	}
+	// Let a sample already in progress finish
+	time.Sleep(10 * time.Millisecond)
+	paused := len(p.Samples())
+
+	time.Sleep(50 * time.Millisecond)
+	if got := len(p.Samples()); got != paused {
+		t.Fatalf("samples added while paused: %d -> %d", paused, got)
+	}
+
+	p.Resume()
+	waitForSamples(paused + 3)
+}
+
+func TestStopHaltsSampling(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	p.StartSampling(5 * time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	p.mu.Lock()
+	stopped := p.samplingDone == nil
+	p.mu.Unlock()
+	if !stopped {
+		t.Fatal("expected Stop to halt background sampling")
+	}
+}
+
+// addSamples appends synthetic snapshots directly to the profiler's ring buffer
+func addSamples(p *GoMemoryProfiler, stats ...MemoryStats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, st := range stats {
+		p.samples = append(p.samples, MemorySnapshot{Stats: st})
+	}
+}
+
+// linearSeries builds n samples spaced step ms apart with Alloc and HeapInuse
+// growing by delta per sample
+func linearSeries(n int, step int64, start, delta uint64) []MemoryStats {
+	stats := make([]MemoryStats, n)
+	for i := range stats {
+		value := start + uint64(i)*delta
+		stats[i] = MemoryStats{
+			Timestamp: int64(i) * step,
+			Alloc:     value,
+			HeapInuse: value,
+		}
+	}
+	return stats
+}
+
+func TestSamplesReturnsCopy(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	addSamples(p, linearSeries(5, 1000, 10<<20, 2<<20)...)
+
+	before := p.DetectMemoryLeaks()
+
+	samples := p.Samples()
+	if len(samples) != 5 {
+		t.Fatalf("expected 5 samples, got %d", len(samples))
+	}
+	for i := range samples {
+		samples[i].Stats.Alloc = 0
+		samples[i].Stats.HeapInuse = 0
+		samples[i].Stats.Timestamp = 0
+	}
+
+	after := p.DetectMemoryLeaks()
+	if before != after {
+		t.Fatalf("mutating Samples() changed leak detection: %+v -> %+v", before, after)
+	}
+	if !after.IsLeakDetected {
+		t.Fatal("expected leak to still be detected")
+	}
+}
+
+func TestReset(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	for i := 0; i < 10; i++ {
+		p.GetMemoryStats()
+	}
+
+	p.Reset()
+
+	if n := len(p.Samples()); n != 0 {
+		t.Fatalf("expected no samples after reset, got %d", n)
+	}
+	if result := p.DetectMemoryLeaks(); result.Status != "insufficient_data" {
+		t.Fatalf("expected insufficient_data, got %q", result.Status)
+	}
+}
+
+func TestSetMaxSamples(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	addSamples(p, linearSeries(100, 1000, 0, 1)...)
+
+	p.SetMaxSamples(10)
+	samples := p.Samples()
+	if len(samples) != 10 {
+		t.Fatalf("expected 10 samples after shrinking, got %d", len(samples))
+	}
+	for i, sample := range samples {
+		if want := uint64(90 + i); sample.Stats.Alloc != want {
+			t.Fatalf("sample %d: expected alloc %d, got %d", i, want, sample.Stats.Alloc)
+		}
+	}
+
+	p.SetMaxSamples(50)
+	for i := 0; i < 45; i++ {
+		p.AddSyntheticSample(MemoryStats{Timestamp: int64(100+i) * 1000})
+	}
+	samples = p.Samples()
+	if len(samples) != 50 || samples[0].Stats.Alloc != 95 {
+		t.Fatalf("expected 50 samples keeping the newest, got %d starting at alloc %d", len(samples), samples[0].Stats.Alloc)
+	}
+}
+
+func TestPeaks(t *testing.T) {
+	// A small buffer so the peak is evicted before the run ends
+	p := NewGoMemoryProfiler(3)
+
+	heap := []uint64{10 << 20, 20 << 20, 90 << 20, 30 << 20, 20 << 20, 10 << 20}
+	goroutines := []int{5, 8, 12, 40, 9, 6}
+	for i := range heap {
+		p.AddSyntheticSample(MemoryStats{
+			Timestamp:  int64(i+1) * 1000,
+			HeapInuse:  heap[i],
+			Goroutines: goroutines[i],
+		})
+	}
+
+	want := PeakStats{
+		HeapInuse:           90 << 20,
+		HeapInuseTimestamp:  3000,
+		Goroutines:          40,
+		GoroutinesTimestamp: 4000,
+	}
+	if got := p.Peaks(); got != want {
+		t.Fatalf("got %+v\nwant %+v", got, want)
+	}
+
+	p.Reset()
+	if got := p.Peaks(); got != (PeakStats{}) {
+		t.Fatalf("expected peaks to be cleared by Reset, got %+v", got)
+	}
+}
+
+func TestSparkline(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	if got := p.Sparkline(8); got != "" {
+		t.Fatalf("expected an empty sparkline without samples, got %q", got)
+	}
+
+	addSamples(p, linearSeries(10, 1000, 10<<20, 1<<20)...)
+
+	got := []rune(p.Sparkline(8))
+	if len(got) != 8 {
+		t.Fatalf("expected 8 blocks, got %d (%q)", len(got), string(got))
+	}
+	if got[0] != '▁' || got[len(got)-1] != '█' {
+		t.Fatalf("expected an ascending series from lowest to tallest block, got %q", string(got))
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i] < got[i-1] {
+			t.Fatalf("expected non-decreasing blocks, got %q", string(got))
+		}
+	}
+
+	if got := []rune(p.Sparkline(50)); len(got) != 10 {
+		t.Fatalf("expected one block per retained sample, got %d", len(got))
+	}
+}
+
+func TestTopSamplesByHeap(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	series := linearSeries(6, 1000, 0, 0)
+	for i, mb := range []uint64{10, 70, 30, 90, 70, 20} {
+		series[i].HeapInuse = mb << 20
+	}
+	addSamples(p, series...)
+
+	top := p.TopSamplesByHeap(3)
+	if len(top) != 3 {
+		t.Fatalf("expected 3 samples, got %d", len(top))
+	}
+	want := []struct {
+		heap      uint64
+		timestamp int64
+	}{{90 << 20, 3000}, {70 << 20, 1000}, {70 << 20, 4000}}
+	for i, w := range want {
+		if top[i].Stats.HeapInuse != w.heap || top[i].Stats.Timestamp != w.timestamp {
+			t.Fatalf("position %d: expected %d at %d, got %d at %d", i, w.heap, w.timestamp,
+				top[i].Stats.HeapInuse, top[i].Stats.Timestamp)
+		}
+	}
+
+	if got := p.TopSamplesByHeap(10); len(got) != 6 {
+		t.Fatalf("expected all 6 samples when n exceeds the count, got %d", len(got))
+	}
+}
+
+func TestTagSnapshot(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	p.TagSnapshot("startup")
+	p.AddSyntheticSample(MemoryStats{Timestamp: 2000})
+	p.AddSyntheticSample(MemoryStats{Timestamp: 3000})
+	p.TagSnapshot("steady")
+	p.AddSyntheticSample(MemoryStats{Timestamp: 4000})
+
+	startup := p.SamplesByTag("startup")
+	if len(startup) != 1 || startup[0].Stats.Timestamp == 0 {
+		t.Fatalf("expected the sample taken by TagSnapshot to be labelled, got %+v", startup)
+	}
+	steady := p.SamplesByTag("steady")
+	if len(steady) != 1 || steady[0].Stats.Timestamp != 3000 {
+		t.Fatalf("expected the 3000ms sample to be labelled steady, got %+v", steady)
+	}
+	if got := p.SamplesByTag("shutdown"); len(got) != 0 {
+		t.Fatalf("expected no samples for an unused label, got %+v", got)
+	}
+}
+
+func TestLeakThresholdDefault(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	if p.LeakThresholdBytesPerSec != 1024*1024 {
+		t.Fatalf("expected default threshold of 1MB/sec, got %d", p.LeakThresholdBytesPerSec)
+	}
+
+	// 3MB/sec exceeds the default threshold
+	addSamples(p, linearSeries(5, 1000, 10<<20, 3<<20)...)
+	if result := p.DetectMemoryLeaks(); !result.IsLeakDetected {
+		t.Fatalf("expected leak at default threshold, got %+v", result)
+	}
+}
+
+func TestSetLeakThreshold(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	p.SetLeakThreshold(5 * 1024 * 1024)
+	addSamples(p, linearSeries(5, 1000, 10<<20, 3<<20)...)
+
+	result := p.DetectMemoryLeaks()
+	if result.IsLeakDetected {
+		t.Fatalf("3MB/sec growth should not be flagged at 5MB/sec threshold: %+v", result)
+	}
+	if result.GrowthRateMBPerSec != 3 {
+		t.Fatalf("expected 3MB/sec growth, got %v", result.GrowthRateMBPerSec)
+	}
+	if result.Magnitude != 60 {
+		t.Fatalf("expected magnitude relative to threshold (60), got %v", result.Magnitude)
+	}
+}
+
+func TestDetectMemoryLeaksRegression(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	// Flat series with small jitter and a single spike in the final sample
+	stats := linearSeries(20, 1000, 10<<20, 0)
+	for i := range stats {
+		if i%2 == 0 {
+			stats[i].HeapInuse += 64 << 10
+		}
+	}
+	stats[len(stats)-1].HeapInuse += 5 << 20
+	addSamples(p, stats...)
+
+	if old := p.DetectMemoryLeaks(); !old.IsLeakDetected {
+		t.Fatalf("expected endpoint method to false-positive on spike, got %+v", old)
+	}
+
+	result := p.DetectMemoryLeaksRegression()
+	if result.IsLeakDetected {
+		t.Fatalf("regression method flagged a flat series: %+v", result)
+	}
+	if result.RSquared >= 0.5 {
+		t.Fatalf("expected poor fit for noisy series, got R²=%v", result.RSquared)
+	}
+}
+
+func TestDetectMemoryLeaksRegressionLinearClimb(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	addSamples(p, linearSeries(20, 1000, 10<<20, 2<<20)...)
+
+	result := p.DetectMemoryLeaksRegression()
+	if !result.IsLeakDetected {
+		t.Fatalf("expected leak for steady climb, got %+v", result)
+	}
+	if result.GrowthRateMBPerSec < 1.99 || result.GrowthRateMBPerSec > 2.01 {
+		t.Fatalf("expected ~2MB/sec slope, got %v", result.GrowthRateMBPerSec)
+	}
+	if result.RSquared < 0.99 {
+		t.Fatalf("expected near-perfect fit, got R²=%v", result.RSquared)
+	}
+}
+
+func TestDetectMemoryLeaksWindow(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	// A minute of 1-second samples: flat for 30s, then climbing 2MB/sec
+	series := linearSeries(61, 1000, 10<<20, 0)
+	for i := 30; i < len(series); i++ {
+		series[i].HeapInuse += uint64(i-30) * (2 << 20)
+	}
+	addSamples(p, series...)
+
+	result := p.DetectMemoryLeaksWindow(30 * time.Second)
+	if result.Status != "analyzed" || result.DurationSeconds != 30 {
+		t.Fatalf("expected a 30 second window, got %+v", result)
+	}
+	if !result.IsLeakDetected || result.GrowthRateMBPerSec < 1.99 || result.GrowthRateMBPerSec > 2.01 {
+		t.Fatalf("expected ~2MB/sec leak over the trailing window, got %+v", result)
+	}
+	if result.TotalGrowthMB != 60 {
+		t.Fatalf("expected 60MB growth across the window, got %v", result.TotalGrowthMB)
+	}
+
+	if result := p.DetectMemoryLeaksWindow(500 * time.Millisecond); result.Status != "insufficient_data" {
+		t.Fatalf("expected insufficient_data for a window holding one sample, got %+v", result)
+	}
+}
+
+func TestApplySensitivity(t *testing.T) {
+	tests := []struct {
+		level     Sensitivity
+		threshold uint64
+		smoothing float64
+		window    time.Duration
+	}{
+		{SensitivityLow, 5 << 20, 0.1, 5 * time.Minute},
+		{SensitivityMedium, 1 << 20, 0.2, time.Minute},
+		{SensitivityHigh, 256 << 10, 0.4, 15 * time.Second},
+	}
+	for _, tt := range tests {
+		p := NewGoMemoryProfiler(100)
+		if err := p.ApplySensitivity(tt.level); err != nil {
+			t.Fatal(err)
+		}
+		if p.LeakThresholdBytesPerSec != tt.threshold || p.SmoothingFactor != tt.smoothing || p.LeakWindow != tt.window {
+			t.Fatalf("sensitivity %d: got threshold=%d smoothing=%v window=%v", tt.level,
+				p.LeakThresholdBytesPerSec, p.SmoothingFactor, p.LeakWindow)
+		}
+	}
+
+	if err := NewGoMemoryProfiler(100).ApplySensitivity(Sensitivity(9)); err == nil {
+		t.Fatal("expected error for unknown sensitivity")
+	}
+}
+
+func TestLeakWindowAlerting(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	leaks := make(chan LeakDetectionResult, 1)
+	p.OnLeakDetected(func(r LeakDetectionResult) { leaks <- r })
+
+	// 20 seconds of 2MB/sec growth, analyzed over the trailing 10 seconds
+	addSamples(p, linearSeries(21, 1000, 10<<20, 2<<20)...)
+	p.LeakWindow = 10 * time.Second
+	p.checkLeak()
+
+	select {
+	case result := <-leaks:
+		if result.DurationSeconds != 10 {
+			t.Fatalf("expected the alert to cover the 10 second window, got %+v", result)
+		}
+	default:
+		t.Fatal("expected a leak alert")
+	}
+}
+
+func TestLeakSeverity(t *testing.T) {
+	tests := []struct {
+		name       string
+		mbPerSec   float64
+		want       string
+		wantLeaked bool
+	}{
+		{"shrinking", -3, SeverityNone, false},
+		{"below threshold", 0.5, SeverityNone, false},
+		{"minor", 1.5, SeverityMinor, true},
+		{"minor at 2x", 2, SeverityMinor, true},
+		{"major", 4, SeverityMajor, true},
+		{"critical", 8, SeverityCritical, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 1MB/sec default threshold; five samples one second apart
+			stats := linearSeries(5, 1000, 0, 0)
+			for i := range stats {
+				stats[i].HeapInuse = uint64(100<<20 + tt.mbPerSec*float64(i)*(1<<20))
+			}
+			p := NewGoMemoryProfiler(100)
+			addSamples(p, stats...)
+
+			result := p.DetectMemoryLeaks()
+			if result.Severity != tt.want || result.IsLeakDetected != tt.wantLeaked {
+				t.Fatalf("expected %s (leak %v), got %s (leak %v) at %.2f MB/sec",
+					tt.want, tt.wantLeaked, result.Severity, result.IsLeakDetected, result.GrowthRateMBPerSec)
+			}
+		})
+	}
+}
+
+func TestLeakTrendAndPeakGrowth(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	// Climbs 40MB then falls back below the starting point
+	series := linearSeries(5, 1000, 0, 0)
+	for i, mb := range []uint64{10, 30, 50, 30, 8} {
+		series[i].HeapInuse = mb << 20
+	}
+	addSamples(p, series...)
+
+	result := p.DetectMemoryLeaks()
+	if result.Trend != "shrinking" || result.TotalGrowthMB != -2 {
+		t.Fatalf("expected a net shrink of 2MB, got %+v", result)
+	}
+	if result.PeakGrowthMB != 40 {
+		t.Fatalf("expected 40MB peak growth within the window, got %v", result.PeakGrowthMB)
+	}
+
+	p.Reset()
+	addSamples(p, linearSeries(5, 1000, 10<<20, 3<<20)...)
+	if result := p.DetectMemoryLeaks(); result.Trend != "growing" || result.PeakGrowthMB != result.TotalGrowthMB {
+		t.Fatalf("expected a steady climb to peak at its total growth, got %+v", result)
+	}
+
+	p.Reset()
+	addSamples(p, linearSeries(5, 1000, 10<<20, 1<<10)...)
+	if result := p.DetectMemoryLeaksRegression(); result.Trend != "stable" {
+		t.Fatalf("expected 1KB/sec to be stable, got %+v", result)
+	}
+}
+
+func TestLeakMetricDefault(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	if p.LeakMetric != MetricHeapInuse {
+		t.Fatalf("expected MetricHeapInuse by default, got %v", p.LeakMetric)
+	}
+}
+
+func TestLeakMetricHeapObjects(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	// Alloc stays flat while live objects climb by 10k per second
+	stats := make([]MemoryStats, 5)
+	for i := range stats {
+		stats[i] = MemoryStats{
+			Timestamp:   int64(i) * 1000,
+			Alloc:       10 << 20,
+			HeapInuse:   12 << 20,
+			HeapObjects: 50000 + uint64(i)*10000,
+		}
+	}
+	addSamples(p, stats...)
+
+	p.LeakMetric = MetricAlloc
+	if result := p.DetectMemoryLeaks(); result.IsLeakDetected {
+		t.Fatalf("flat Alloc should not be flagged: %+v", result)
+	}
+
+	p.LeakMetric = MetricHeapObjects
+	p.SetLeakThreshold(1000)
+	result := p.DetectMemoryLeaks()
+	if !result.IsLeakDetected {
+		t.Fatalf("expected HeapObjects growth to be flagged: %+v", result)
+	}
+	if result.Metric != "heapObjects" || result.GrowthRateMBPerSec != 10000 {
+		t.Fatalf("unexpected metric or rate: %+v", result)
+	}
+}
+
+func TestUnits(t *testing.T) {
+	// 4GB of growth over 4 seconds
+	series := linearSeries(5, 1000, 0, 1<<30)
+
+	cases := []struct {
+		unit  Unit
+		name  string
+		total float64
+		rate  float64
+	}{
+		{UnitKB, "KB", 4 << 20, 1 << 20},
+		{UnitMB, "MB", 4 << 10, 1 << 10},
+		{UnitGB, "GB", 4, 1},
+	}
+	for _, tc := range cases {
+		p := NewGoMemoryProfiler(100)
+		p.SetUnits(tc.unit)
+		addSamples(p, series...)
+
+		result := p.DetectMemoryLeaks()
+		if result.Unit != tc.name || result.TotalGrowthMB != tc.total || result.GrowthRateMBPerSec != tc.rate {
+			t.Fatalf("%s: unexpected result %+v", tc.name, result)
+		}
+		if gc := p.ForceGC(); gc.Unit != tc.name {
+			t.Fatalf("%s: expected GC result unit, got %q", tc.name, gc.Unit)
+		}
+	}
+
+	if NewGoMemoryProfiler(100).Units != UnitMB {
+		t.Fatal("expected MB to be the default unit")
+	}
+}
+
+func goroutineSeries(counts ...int) []MemoryStats {
+	stats := make([]MemoryStats, len(counts))
+	for i, n := range counts {
+		stats[i] = MemoryStats{Timestamp: int64(i) * 1000, Goroutines: n}
+	}
+	return stats
+}
+
+func TestDetectStackGrowth(t *testing.T) {
+	// Flat goroutine count while stacks grow 256KB/sec
+	p := NewGoMemoryProfiler(100)
+	stats := goroutineSeries(20, 20, 20, 20, 20)
+	for i := range stats {
+		stats[i].StackInuse = 1<<20 + uint64(i)*(256<<10)
+	}
+	addSamples(p, stats...)
+
+	result := p.DetectStackGrowth()
+	if !result.IsAbnormal || result.Cause != StackCauseDeeperStacks {
+		t.Fatalf("expected deeper stacks, got %+v", result)
+	}
+	if result.GrowthBytesPerSec != 256<<10 || result.GoroutineGrowthPerSec != 0 {
+		t.Fatalf("unexpected growth rates: %+v", result)
+	}
+
+	// Goroutines and stack bytes growing together
+	p = NewGoMemoryProfiler(100)
+	stats = goroutineSeries(20, 40, 60, 80, 100)
+	for i := range stats {
+		stats[i].StackInuse = uint64(stats[i].Goroutines) * (8 << 10)
+	}
+	addSamples(p, stats...)
+	if result := p.DetectStackGrowth(); !result.IsAbnormal || result.Cause != StackCauseMoreGoroutines {
+		t.Fatalf("expected more goroutines, got %+v", result)
+	}
+
+	// Slow growth is not flagged
+	p = NewGoMemoryProfiler(100)
+	stats = goroutineSeries(20, 20, 20, 20, 20)
+	for i := range stats {
+		stats[i].StackInuse = 1<<20 + uint64(i)*(1<<10)
+	}
+	addSamples(p, stats...)
+	if result := p.DetectStackGrowth(); result.IsAbnormal || result.Cause != "" {
+		t.Fatalf("expected no abnormal growth, got %+v", result)
+	}
+}
+
+func TestDetectGoroutineLeaksIncreasing(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	addSamples(p, goroutineSeries(10, 12, 14, 14, 16, 18)...)
+
+	result := p.DetectGoroutineLeaks()
+	if !result.IsLeakDetected {
+		t.Fatalf("expected goroutine leak, got %+v", result)
+	}
+	if result.CurrentCount != 18 {
+		t.Fatalf("expected current count 18, got %d", result.CurrentCount)
+	}
+	// 8 goroutines over 5 seconds
+	if result.GrowthPerMinute != 96 {
+		t.Fatalf("expected 96 goroutines/minute, got %v", result.GrowthPerMinute)
+	}
+}
+
+func TestDetectAllLeaks(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	stats := goroutineSeries(10, 30, 50, 70, 90)
+	for i := range stats {
+		stats[i].HeapInuse = 100 << 20
+		stats[i].HeapObjects = 50000
+		stats[i].StackInuse = 1 << 20
+	}
+	addSamples(p, stats...)
+
+	results := p.DetectAllLeaks()
+	for _, metric := range []string{"heapInuse", "heapObjects", "stackInuse", "goroutines"} {
+		result, ok := results[metric]
+		if !ok {
+			t.Fatalf("missing a verdict for %s", metric)
+		}
+		if result.Status != "analyzed" {
+			t.Fatalf("expected %s to be analyzed, got %q", metric, result.Status)
+		}
+		if want := metric == "goroutines"; result.IsLeakDetected != want {
+			t.Fatalf("expected %s leak %v, got %+v", metric, want, result)
+		}
+	}
+	if got := results["goroutines"]; got.GrowthRateMBPerSec != 20 || got.Unit != "goroutines" {
+		t.Fatalf("expected 20 goroutines/sec, got %f %s", got.GrowthRateMBPerSec, got.Unit)
+	}
+
+	if result := NewGoMemoryProfiler(100).DetectAllLeaks()["heapInuse"]; result.Status != "insufficient_data" {
+		t.Fatalf("expected insufficient_data without samples, got %q", result.Status)
+	}
+}
+
+func TestDetectAllLeaksHeapObjects(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	// 5000 new objects per second on a flat heap, stack and goroutine count
+	for i := 0; i < 5; i++ {
+		addSamples(p, MemoryStats{
+			Timestamp:   int64(i+1) * 1000,
+			HeapInuse:   100 << 20,
+			HeapObjects: 50000 + uint64(i)*5000,
+			StackInuse:  1 << 20,
+			Goroutines:  10,
+		})
+	}
+
+	results := p.DetectAllLeaks()
+	for metric, result := range results {
+		if want := metric == "heapObjects"; result.IsLeakDetected != want {
+			t.Fatalf("expected %s leak %v, got %+v", metric, want, result)
+		}
+	}
+	if got := results["heapObjects"].GrowthRateMBPerSec; got != 5000 {
+		t.Fatalf("expected 5000 objects/sec, got %v", got)
+	}
+}
+
+func TestDetectGoroutineLeaksStable(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	addSamples(p, goroutineSeries(10, 11, 10, 12, 10, 11)...)
+
+	result := p.DetectGoroutineLeaks()
+	if result.IsLeakDetected || result.Monotonic {
+		t.Fatalf("stable goroutine count flagged as leak: %+v", result)
+	}
+	if result.Status != "analyzed" {
+		t.Fatalf("expected analyzed status, got %q", result.Status)
+	}
+}
+
+func blockOnChannel(ready *sync.WaitGroup, ch chan struct{}) {
+	ready.Done()
+	<-ch
+}
+
+func TestGoroutineSummary(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	ch := make(chan struct{})
+	defer close(ch)
+
+	var ready sync.WaitGroup
+	ready.Add(20)
+	for i := 0; i < 20; i++ {
+		go blockOnChannel(&ready, ch)
+	}
+	ready.Wait()
+	time.Sleep(10 * time.Millisecond)
+
+	if dump := p.GoroutineDump(); !strings.Contains(dump, "blockOnChannel") {
+		t.Fatal("expected dump to contain the blocking function")
+	}
+
+	var blocked int
+	for frame, count := range p.GoroutineSummary() {
+		if strings.HasSuffix(frame, ".blockOnChannel") {
+			blocked += count
+		}
+	}
+	if blocked < 20 {
+		t.Fatalf("expected at least 20 goroutines in blockOnChannel, got %d", blocked)
+	}
+}
+
+func TestAdaptiveSampling(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	p.StartAdaptiveSampling(context.Background(), 8*time.Second, time.Second, time.Minute)
+	p.StopSampling()
+
+	if got := p.SampleInterval(); got != 8*time.Second {
+		t.Fatalf("expected the base interval, got %v", got)
+	}
+
+	// Climbing 4MB/sec, above the default 1MB/sec threshold
+	addSamples(p, linearSeries(3, 1000, 10<<20, 4<<20)...)
+	for _, want := range []time.Duration{4 * time.Second, 2 * time.Second, time.Second, time.Second} {
+		if got := p.adaptSampleInterval(); got != want {
+			t.Fatalf("climbing series: expected %v, got %v", want, got)
+		}
+	}
+
+	p.Reset()
+	addSamples(p, linearSeries(3, 1000, 10<<20, 0)...)
+	for _, want := range []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second, time.Minute} {
+		if got := p.adaptSampleInterval(); got != want {
+			t.Fatalf("flat series: expected %v, got %v", want, got)
+		}
+	}
+	if got := p.SampleInterval(); got != time.Minute {
+		t.Fatalf("expected SampleInterval to report the adapted interval, got %v", got)
+	}
+}
+
+func TestStartSamplingContextCancel(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.StartSamplingContext(ctx, 5*time.Millisecond)
+
+	deadline := time.Now().Add(time.Second)
+	for len(p.Samples()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	// Give the sampler a moment to observe cancellation
+	deadline = time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("sampler goroutine leaked: %d goroutines before, %d after", before, after)
+	}
+
+	count := len(p.Samples())
+	if count < 3 {
+		t.Fatalf("expected at least 3 samples before cancel, got %d", count)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := len(p.Samples()); n != count {
+		t.Fatalf("sampling continued after cancel: %d -> %d", count, n)
+	}
+
+	// Stop after cancellation must not block
+	p.StopSampling()
+}
+
+func TestServeHTTP(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	server := httptest.NewServer(p.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected application/json, got %q", ct)
+	}
+
+	var stats MemoryStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Timestamp == 0 || stats.HeapSys == 0 {
+		t.Fatalf("expected populated stats, got %+v", stats)
+	}
+}
+
+func TestRegisterPprofHandlers(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	mux := http.NewServeMux()
+	p.RegisterPprofHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/debug/memstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var stats MemoryStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.HeapSys == 0 {
+		t.Fatalf("expected populated stats, got %+v", stats)
+	}
+
+	for _, path := range []string{"/debug/leaks", "/debug/pprof/", "/debug/pprof/heap"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	handler := p.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/heavy" {
+			allocSink = make([]byte, 1<<20)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for _, path := range []string{"/heavy", "/heavy", "/light"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	allocSink = nil
+
+	stats := p.EndpointStats()
+	heavy, ok := stats["/heavy"]
+	if !ok || heavy.Requests != 2 {
+		t.Fatalf("expected 2 requests recorded for /heavy, got %+v", stats)
+	}
+	if heavy.TotalBytes < 2<<20 || heavy.MaxBytes < 1<<20 || heavy.TotalAllocs == 0 {
+		t.Fatalf("expected at least 1MB allocated per /heavy request, got %+v", heavy)
+	}
+	if heavy.BytesPerRequest != float64(heavy.TotalBytes)/2 {
+		t.Fatalf("expected bytes per request to average the total, got %+v", heavy)
+	}
+	if light := stats["/light"]; light.Requests != 1 || light.TotalBytes >= heavy.MaxBytes {
+		t.Fatalf("expected /light to allocate less than /heavy, got %+v", light)
+	}
+}
+
+func TestMiddlewareEndpointKeys(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	handler := p.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for i := 0; i < maxEndpoints+50; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/item/"+strconv.Itoa(i), nil))
+	}
+	stats := p.EndpointStats()
+	if len(stats) != maxEndpoints+1 {
+		t.Fatalf("expected %d tracked keys plus %q, got %d", maxEndpoints, otherEndpoint, len(stats))
+	}
+	if other := stats[otherEndpoint]; other.Requests != 50 {
+		t.Fatalf("expected 50 requests in %q, got %+v", otherEndpoint, other)
+	}
+
+	p = NewGoMemoryProfiler(100)
+	p.SetEndpointKeyFunc(func(r *http.Request) string {
+		return r.Method + " " + r.URL.Path[:strings.LastIndex(r.URL.Path, "/")]
+	})
+	handler = p.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for i := 0; i < 3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/item/"+strconv.Itoa(i), nil))
+	}
+	stats = p.EndpointStats()
+	if len(stats) != 1 || stats["GET /item"].Requests != 3 {
+		t.Fatalf("expected requests grouped under the custom key, got %+v", stats)
+	}
+}
+
+func TestServeHTTPLeaks(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	server := httptest.NewServer(p.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/leaks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var result LeakDetectionResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != "insufficient_data" {
+		t.Fatalf("expected insufficient_data, got %q", result.Status)
+	}
+}
+
+func TestWriteJSONMarshalError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeJSON(rec, math.Inf(1))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", rec.Code)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body["error"] == "" {
+		t.Fatalf("expected JSON error body, got %q", rec.Body.String())
+	}
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	server := httptest.NewServer(p.PrometheusHandler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{
+		"omniprofiler_heap_alloc_bytes",
+		"omniprofiler_heap_inuse_bytes",
+		"omniprofiler_heap_objects",
+		"omniprofiler_gc_cycles",
+		"omniprofiler_gc_cpu_fraction",
+		"omniprofiler_goroutines",
+	} {
+		if !strings.Contains(string(body), "# TYPE "+name+" gauge\n") {
+			t.Errorf("missing TYPE line for %s", name)
+		}
+		if !strings.Contains(string(body), "\n"+name+" ") {
+			t.Errorf("missing sample for %s", name)
+		}
+	}
+
+	if n := len(p.Samples()); n != 1 {
+		t.Fatalf("expected scrape to record one fresh sample, got %d", n)
+	}
+}
+
+// assertPprofFile checks that path holds a non-empty gzip-compressed profile
+func assertPprofFile(t *testing.T, path string) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		t.Fatalf("expected gzip-compressed pprof profile, got %d bytes", len(data))
+	}
+}
+
+func TestWriteHeapProfile(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	path := filepath.Join(t.TempDir(), "heap.pprof")
+
+	if err := p.WriteHeapProfile(path); err != nil {
+		t.Fatal(err)
+	}
+	assertPprofFile(t, path)
+}
+
+func TestWriteHeapProfileCreateError(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	path := filepath.Join(t.TempDir(), "missing", "heap.pprof")
+
+	if err := p.WriteHeapProfile(path); err == nil {
+		t.Fatal("expected error for unwritable path")
+	}
+}
+
+func TestCPUProfile(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	path := filepath.Join(t.TempDir(), "cpu.pprof")
+
+	if err := p.StartCPUProfile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.StartCPUProfile(path); err == nil {
+		t.Fatal("expected error when starting a second cpu profile")
+	}
+
+	// Keep the CPU busy so the profile has samples
+	deadline := time.Now().Add(100 * time.Millisecond)
+	x := 0
+	for time.Now().Before(deadline) {
+		x++
+	}
+	_ = x
+
+	if err := p.StopCPUProfile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.StopCPUProfile(); err == nil {
+		t.Fatal("expected error when stopping without an active profile")
+	}
+	assertPprofFile(t, path)
+}
+
+func TestGetMemoryStatsWithDelta(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	first, diff := p.GetMemoryStatsWithDelta()
+	if diff != (MemoryStatsDiff{}) {
+		t.Fatalf("expected a zero diff on the first call, got %+v", diff)
+	}
+
+	retained := make([][]byte, 0, 64)
+	for i := 0; i < 64; i++ {
+		retained = append(retained, make([]byte, 4096))
+	}
+	second, diff := p.GetMemoryStatsWithDelta()
+	runtime.KeepAlive(retained)
+
+	want := DiffSnapshots(MemorySnapshot{Stats: first}, MemorySnapshot{Stats: second})
+	if diff != want {
+		t.Fatalf("expected diff %+v, got %+v", want, diff)
+	}
+	if diff.Mallocs <= 0 {
+		t.Fatalf("expected mallocs between samples, got %d", diff.Mallocs)
+	}
+	if samples := p.Samples(); len(samples) != 2 || samples[1].Stats.Timestamp != second.Timestamp {
+		t.Fatalf("expected both calls to record samples, got %d", len(samples))
+	}
+}
+
+func TestGetMemoryStatsTimeout(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	stats, err := p.GetMemoryStatsTimeout(5 * time.Second)
+	if err != nil || stats.Error != "" || stats.HeapInuse == 0 {
+		t.Fatalf("expected a fast read to succeed, got %+v, %v", stats, err)
+	}
+
+	// The late read reports new GC cycles, which must not reach the event log
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	p.readMemStats = func(m *runtime.MemStats) {
+		<-release
+		runtime.ReadMemStats(m)
+		m.NumGC += 10
+		close(finished)
+	}
+	p.mu.Lock()
+	lastNumGC := p.gcLastNumGC
+	p.mu.Unlock()
+
+	stats, err = p.GetMemoryStatsTimeout(20 * time.Millisecond)
+	if !errors.Is(err, ErrStatsTimeout) {
+		t.Fatalf("expected ErrStatsTimeout, got %v", err)
+	}
+	if stats.Error == "" || stats.Timestamp == 0 {
+		t.Fatalf("expected a timestamped error result, got %+v", stats)
+	}
+	if got := len(p.Samples()); got != 1 {
+		t.Fatalf("expected the timed-out read not to be recorded, got %d samples", got)
+	}
+
+	close(release)
+	<-finished
+	time.Sleep(20 * time.Millisecond)
+	p.mu.Lock()
+	if p.gcLastNumGC != lastNumGC {
+		t.Errorf("late read updated GC bookkeeping: NumGC %d, was %d", p.gcLastNumGC, lastNumGC)
+	}
+	p.mu.Unlock()
+
+	p.readMemStats = func(*runtime.MemStats) { panic("unavailable") }
+	if _, err := p.GetMemoryStatsTimeout(time.Second); err == nil || !strings.Contains(err.Error(), "unavailable") {
+		t.Fatalf("expected the panic as an error, got %v", err)
+	}
+}
+
+func TestEqualIgnoringTime(t *testing.T) {
+	a := MemoryStats{Timestamp: 1000, Time: formatTimestamp(1000), HeapInuse: 64 << 20, NumGC: 3, LastGC: 10, PauseEnd: 10}
+	b := a
+	b.Timestamp = 5000
+	b.Time = formatTimestamp(5000)
+	b.LastGC = 20
+	b.PauseEnd = 20
+	b.Error = "partial read"
+
+	if !a.EqualIgnoringTime(b) {
+		t.Fatal("expected stats differing only in time to compare equal")
+	}
+	if a.Timestamp != 1000 || b.Error == "" {
+		t.Fatal("comparison modified its operands")
+	}
+
+	b.HeapInuse++
+	if a.EqualIgnoringTime(b) {
+		t.Fatal("expected a HeapInuse difference to compare unequal")
+	}
+}
+
+func TestWindowGrowth(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	if got := p.WindowGrowth(); got.Status != "insufficient_data" {
+		t.Fatalf("expected insufficient_data without samples, got %+v", got)
+	}
+
+	addSamples(p,
+		MemoryStats{Timestamp: 1000, HeapInuse: 50 << 20, HeapObjects: 1000, NumGC: 2, Goroutines: 8},
+		MemoryStats{Timestamp: 2000, HeapInuse: 90 << 20, HeapObjects: 9000, NumGC: 3, Goroutines: 40},
+		MemoryStats{Timestamp: 61000, HeapInuse: 70 << 20, HeapObjects: 4000, NumGC: 9, Goroutines: 5},
+	)
+
+	want := MemoryStatsDiff{
+		DurationMs:  60000,
+		HeapInuse:   20 << 20,
+		HeapObjects: 3000,
+		NumGC:       7,
+		Goroutines:  -3,
+		Status:      "analyzed",
+	}
+	if got := p.WindowGrowth(); got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	before := MemorySnapshot{Stats: MemoryStats{
+		Timestamp:   1000,
+		Alloc:       8 << 20,
+		HeapInuse:   10 << 20,
+		HeapObjects: 5000,
+		Mallocs:     1000,
+		Frees:       400,
+		NumGC:       3,
+		Goroutines:  12,
+	}}
+	after := MemorySnapshot{Stats: MemoryStats{
+		Timestamp:   3500,
+		Alloc:       6 << 20,
+		HeapInuse:   14 << 20,
+		HeapObjects: 4000,
+		Mallocs:     1800,
+		Frees:       1500,
+		NumGC:       5,
+		Goroutines:  9,
+	}}
+
+	diff := DiffSnapshots(before, after)
+	want := MemoryStatsDiff{
+		DurationMs:  2500,
+		Alloc:       -2 << 20,
+		HeapInuse:   4 << 20,
+		HeapObjects: -1000,
+		Mallocs:     800,
+		Frees:       1100,
+		NumGC:       2,
+		Goroutines:  -3,
+	}
+	if diff != want {
+		t.Fatalf("unexpected diff:\n got %+v\nwant %+v", diff, want)
+	}
+}
+
+func TestPercentileStats(t *testing.T) {
+	p := NewGoMemoryProfiler(200)
+
+	if report := p.PercentileStats(); report.Status != "insufficient_data" {
+		t.Fatalf("expected insufficient_data, got %q", report.Status)
+	}
+
+	// Insert 1..100 out of order
+	for i := 100; i >= 1; i-- {
+		addSamples(p, MemoryStats{HeapInuse: uint64(i) << 20, PauseNs: uint64(i) * 1000})
+	}
+
+	report := p.PercentileStats()
+	wantHeap := Percentiles{P50: 50 << 20, P90: 90 << 20, P99: 99 << 20, Max: 100 << 20}
+	wantPause := Percentiles{P50: 50000, P90: 90000, P99: 99000, Max: 100000}
+	if report.HeapInuse != wantHeap {
+		t.Fatalf("unexpected heap percentiles: %+v", report.HeapInuse)
+	}
+	if report.PauseNs != wantPause {
+		t.Fatalf("unexpected pause percentiles: %+v", report.PauseNs)
+	}
+	if report.SampleCount != 100 {
+		t.Fatalf("expected 100 samples, got %d", report.SampleCount)
+	}
+
+	// Sorting must not reorder the retained samples
+	if first := p.Samples()[0].Stats.HeapInuse; first != 100<<20 {
+		t.Fatalf("samples were reordered, first HeapInuse is %d", first)
+	}
+}
+
+func TestSaveLoadSamples(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "samples.json")
+
+	original := NewGoMemoryProfiler(100)
+	addSamples(original, linearSeries(10, 1000, 10<<20, 2<<20)...)
+	if err := original.SaveSamples(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewGoMemoryProfiler(100)
+	if err := loaded.LoadSamples(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(loaded.Samples()); n != 10 {
+		t.Fatalf("expected 10 loaded samples, got %d", n)
+	}
+	if want, got := original.DetectMemoryLeaks(), loaded.DetectMemoryLeaks(); want != got {
+		t.Fatalf("leak detection differs after round trip:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestLoadSamplesResetsPeaks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "samples.json")
+
+	original := NewGoMemoryProfiler(100)
+	for _, stats := range linearSeries(5, 1000, 10<<20, 1<<20) {
+		stats.Timestamp += 1000
+		original.recordSample(stats)
+	}
+	if err := original.SaveSamples(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// The loading profiler saw a far higher peak and Alloc before the load
+	loaded := NewGoMemoryProfiler(100)
+	loaded.recordSample(MemoryStats{Timestamp: 1000, Alloc: 500 << 20, HeapInuse: 500 << 20, Goroutines: 50})
+	if err := loaded.LoadSamples(path); err != nil {
+		t.Fatal(err)
+	}
+
+	peaks := loaded.Peaks()
+	if peaks.HeapInuse != 14<<20 || peaks.HeapInuseTimestamp != 5000 || peaks.Goroutines != 0 {
+		t.Fatalf("expected peaks from the loaded samples, got %+v", peaks)
+	}
+
+	// The moving average continues from the loaded series
+	last := loaded.Samples()[4].SmoothedAlloc
+	loaded.recordSample(MemoryStats{Timestamp: 6000, Alloc: 15 << 20, HeapInuse: 15 << 20})
+	got := loaded.Samples()[5].SmoothedAlloc
+	want := defaultSmoothingFactor*float64(15<<20) + (1-defaultSmoothingFactor)*last
+	if math.Abs(got-want) > 1 {
+		t.Fatalf("expected smoothed Alloc %v continuing the loaded series, got %v", want, got)
+	}
+}
+
+func TestSaveLoadSamplesBinary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "samples.gob")
+
+	original := NewGoMemoryProfiler(100)
+	for i := 0; i < 10; i++ {
+		original.GetMemoryStats()
+	}
+	if err := original.SaveSamplesBinary(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewGoMemoryProfiler(100)
+	if err := loaded.LoadSamplesBinary(path); err != nil {
+		t.Fatal(err)
+	}
+
+	want, got := original.Samples(), loaded.Samples()
+	if len(got) != len(want) {
+		t.Fatalf("expected %d loaded samples, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("sample %d differs after round trip:\n got %+v\nwant %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestLoadSamplesTrimsToMaxSamples(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "samples.json")
+
+	original := NewGoMemoryProfiler(100)
+	addSamples(original, linearSeries(10, 1000, 0, 1)...)
+	if err := original.SaveSamples(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewGoMemoryProfiler(4)
+	if err := loaded.LoadSamples(path); err != nil {
+		t.Fatal(err)
+	}
+
+	samples := loaded.Samples()
+	if len(samples) != 4 {
+		t.Fatalf("expected 4 samples, got %d", len(samples))
+	}
+	if samples[0].Stats.Alloc != 6 {
+		t.Fatalf("expected oldest samples to be dropped, first Alloc is %d", samples[0].Stats.Alloc)
+	}
+
+	// The load restarts the counters from the file's samples
+	want := BufferStats{TotalSamplesTaken: 10, SamplesEvicted: 6, Retained: 4, Capacity: 4}
+	if got := loaded.BufferStats(); got != want {
+		t.Fatalf("expected %+v after the load, got %+v", want, got)
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	p := NewGoMemoryProfiler(1000)
+	addSamples(p, linearSeries(1000, 1000, 0, 1<<10)...)
+
+	downsampled := p.Downsample(50)
+	if len(downsampled) != 50 {
+		t.Fatalf("expected 50 buckets, got %d", len(downsampled))
+	}
+	for i := 1; i < len(downsampled); i++ {
+		if downsampled[i].Stats.Timestamp <= downsampled[i-1].Stats.Timestamp {
+			t.Fatalf("timestamps not increasing at bucket %d: %d then %d", i,
+				downsampled[i-1].Stats.Timestamp, downsampled[i].Stats.Timestamp)
+		}
+	}
+
+	// The first bucket averages samples 0-19
+	if first := downsampled[0].Stats; first.Timestamp != 9500 || first.HeapInuse != 9728 {
+		t.Fatalf("unexpected first bucket mean: timestamp=%d heapInuse=%d", first.Timestamp, first.HeapInuse)
+	}
+
+	if got := p.Downsample(2000); len(got) != 1000 {
+		t.Fatalf("expected samples unchanged when fewer than the target, got %d", len(got))
+	}
+}
+
+func TestDownsampleUnordered(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	for _, ts := range []int64{2000, 1000, 1999} {
+		p.AddSyntheticSample(MemoryStats{Timestamp: ts, HeapInuse: uint64(ts)})
+	}
+
+	downsampled := p.Downsample(1)
+	if len(downsampled) != 1 {
+		t.Fatalf("expected 1 bucket, got %d", len(downsampled))
+	}
+	if got := downsampled[0].Stats.HeapInuse; got != 1666 {
+		t.Fatalf("expected mean heap in use 1666, got %d", got)
+	}
+
+	downsampled = p.Downsample(2)
+	if len(downsampled) != 2 || downsampled[0].Stats.Timestamp != 1000 {
+		t.Fatalf("expected buckets ordered by timestamp, got %+v", downsampled)
+	}
+
+	// Samples spanning no time are returned unchanged
+	p = NewGoMemoryProfiler(100)
+	for i := 0; i < 10; i++ {
+		p.AddSyntheticSample(MemoryStats{Timestamp: 5000, HeapInuse: uint64(i)})
+	}
+	if got := p.Downsample(3); len(got) != 10 {
+		t.Fatalf("expected 10 equal-timestamp samples unchanged, got %d", len(got))
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	addSamples(p, linearSeries(3, 1000, 1<<30, 1<<20)...)
+
+	var buf bytes.Buffer
+	if err := p.ExportCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("expected header plus 3 rows, got %d records", len(records))
+	}
+
+	header := records[0]
+	if header[0] != "timestamp" || header[1] != "alloc" {
+		t.Fatalf("unexpected header: %v", header)
+	}
+	for i, row := range records[1:] {
+		if len(row) != len(header) {
+			t.Fatalf("row %d has %d fields, header has %d", i, len(row), len(header))
+		}
+	}
+	if got := records[3][1]; got != "1075838976" {
+		t.Fatalf("expected plain integer alloc, got %q", got)
+	}
+}
+
+func TestOnLeakDetectedDebounced(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	p.SetLeakCooldown(time.Hour)
+
+	var calls int
+	p.OnLeakDetected(func(result LeakDetectionResult) {
+		if !result.IsLeakDetected {
+			t.Error("callback received a non-leak result")
+		}
+		calls++
+	})
+
+	// Feed a climbing series one sample at a time, as the sampler would
+	for _, stats := range linearSeries(12, 1000, 10<<20, 4<<20) {
+		addSamples(p, stats)
+		p.checkAlerts()
+	}
+
+	if calls != 1 {
+		t.Fatalf("expected exactly one callback within the cooldown, got %d", calls)
+	}
+}
+
+func TestOnLeakDetectedAfterCooldown(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	p.SetLeakCooldown(0)
+
+	var calls int
+	p.OnLeakDetected(func(LeakDetectionResult) { calls++ })
+
+	addSamples(p, linearSeries(5, 1000, 10<<20, 4<<20)...)
+	p.checkAlerts()
+	p.checkAlerts()
+
+	if calls != 2 {
+		t.Fatalf("expected a callback per check with no cooldown, got %d", calls)
+	}
+}
+
+func TestWebhookOnLeak(t *testing.T) {
+	var attempts int32
+	received := make(chan WebhookPayload, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first attempt to exercise the retry
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("expected a JSON content type, got %q", ct)
+		}
+		var payload WebhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("malformed payload: %v", err)
+		}
+		received <- payload
+	}))
+	defer server.Close()
+
+	p := NewGoMemoryProfiler(100)
+	p.SetClock(newFakeClock())
+	p.SetWebhook(server.URL)
+	for _, stats := range linearSeries(5, 1000, 10<<20, 4<<20) {
+		stats.Timestamp += 1000 // keep AddSyntheticSample from filling in the first
+		p.AddSyntheticSample(stats)
+	}
+
+	select {
+	case payload := <-received:
+		if !payload.Result.IsLeakDetected {
+			t.Fatalf("expected a detected leak in the payload, got %+v", payload.Result)
+		}
+		if !strings.Contains(payload.Text, "leak") {
+			t.Fatalf("expected alert text, got %q", payload.Text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not called")
+	}
+}
+
+func TestStatsDReporter(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	reporter, err := NewStatsDReporter(listener.LocalAddr().String(), "myapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewGoMemoryProfiler(100)
+	p.SetStatsDReporter(reporter)
+	p.StartSampling(5 * time.Millisecond)
+
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := listener.ReadFrom(buf)
+	p.StopSampling()
+	if err != nil {
+		t.Fatalf("no statsd packet received: %v", err)
+	}
+
+	lines := strings.Split(string(buf[:n]), "\n")
+	seen := make(map[string]bool)
+	for _, line := range lines {
+		name, rest, ok := strings.Cut(line, ":")
+		if !ok || !strings.HasSuffix(rest, "|g") {
+			t.Fatalf("malformed statsd line %q", line)
+		}
+		seen[name] = true
+	}
+	for _, name := range []string{"myapp.heap_inuse_bytes", "myapp.heap_objects", "myapp.goroutines", "myapp.gc_cycles", "myapp.gc_cpu_fraction"} {
+		if !seen[name] {
+			t.Fatalf("expected gauge %s, got %v", name, lines)
+		}
+	}
+
+	if err := reporter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := reporter.Report(MemoryStats{}); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("expected os.ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestPeriodicReports(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	for _, stats := range linearSeries(10, 1000, 10<<20, 4<<20) {
+		p.recordSample(stats)
+	}
+
+	var calls int32
+	reports := make(chan HealthReport, 10)
+	p.OnReport(func(report HealthReport) {
+		atomic.AddInt32(&calls, 1)
+		select {
+		case reports <- report:
+		default:
+		}
+	})
+	p.SetReportInterval(5 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case report := <-reports:
+			if !report.Leak.IsLeakDetected || report.Status != HealthCritical {
+				t.Fatalf("expected a critical leak report, got %+v", report)
+			}
+			if report.Peaks.HeapInuse != 46<<20 {
+				t.Fatalf("expected peak HeapInuse in the report, got %d", report.Peaks.HeapInuse)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected 3 reports, got %d", i)
+		}
+	}
+
+	p.SetReportInterval(0)
+	stopped := atomic.LoadInt32(&calls)
+	time.Sleep(30 * time.Millisecond)
+	if got := atomic.LoadInt32(&calls); got != stopped {
+		t.Fatalf("expected no reports after stopping, got %d more", got-stopped)
+	}
+}
+
+func TestDetectGCThrashing(t *testing.T) {
+	series := func(fraction float64, gcPerSample uint32) []MemoryStats {
+		stats := linearSeries(10, 1000, 10<<20, 0)
+		for i := range stats {
+			stats[i].GCCPUFraction = fraction
+			stats[i].NumGC = uint32(i) * gcPerSample
+		}
+		return stats
+	}
+
+	p := NewGoMemoryProfiler(100)
+	addSamples(p, series(0.4, 20)...)
+	result := p.DetectGCThrashing()
+	if !result.IsThrashing {
+		t.Fatalf("expected thrashing, got %+v", result)
+	}
+	if result.Cycles != 180 || math.Abs(result.GCPerSecond-20) > 1e-9 {
+		t.Fatalf("expected 180 cycles at 20/sec, got %d at %f", result.Cycles, result.GCPerSecond)
+	}
+	if math.Abs(result.AvgGCCPUFraction-0.4) > 1e-9 {
+		t.Fatalf("expected average fraction 0.4, got %f", result.AvgGCCPUFraction)
+	}
+
+	// A single dip below the threshold means the pressure is not sustained
+	p = NewGoMemoryProfiler(100)
+	stats := series(0.4, 20)
+	stats[4].GCCPUFraction = 0.1
+	addSamples(p, stats...)
+	if result := p.DetectGCThrashing(); result.IsThrashing {
+		t.Fatalf("expected no thrashing with a dip, got %+v", result)
+	}
+
+	p = NewGoMemoryProfiler(100)
+	p.SetGCThrashingThreshold(0.5)
+	addSamples(p, series(0.4, 20)...)
+	if result := p.DetectGCThrashing(); result.IsThrashing || result.Threshold != 0.5 {
+		t.Fatalf("expected the raised threshold to clear thrashing, got %+v", result)
+	}
+
+	if result := NewGoMemoryProfiler(100).DetectGCThrashing(); result.Status != "insufficient_data" {
+		t.Fatalf("expected insufficient_data, got %q", result.Status)
+	}
+}
+
+func TestSetSoftMemoryLimit(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	const limit = 512 << 20
+	previous := p.SetSoftMemoryLimit(limit)
+	defer p.SetSoftMemoryLimit(previous)
+
+	if stats := p.GetMemoryStats(); stats.MemoryLimit != limit {
+		t.Fatalf("expected memory limit %d, got %d", limit, stats.MemoryLimit)
+	}
+}
+
+var objectSink []*[64]byte
+
+func TestRelativeStats(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	runtime.GC()
+	p.SetBaseline()
+
+	const objects = 20000
+	objectSink = make([]*[64]byte, objects)
+	for i := range objectSink {
+		objectSink[i] = new([64]byte)
+	}
+	defer func() { objectSink = nil }()
+
+	runtime.GC()
+	relative := p.RelativeStats()
+	// Garbage from before the baseline, swept since, offsets a few objects
+	if relative.HeapObjects < objects-1000 || relative.HeapObjects > objects+5000 {
+		t.Fatalf("expected about %d new heap objects, got %d", objects, relative.HeapObjects)
+	}
+	if relative.NumGC < 1 {
+		t.Fatalf("expected the GC since the baseline to be counted, got %d", relative.NumGC)
+	}
+	if relative.Timestamp == 0 || relative.Time == "" {
+		t.Fatal("expected an absolute timestamp")
+	}
+	if len(p.Samples()) != 0 {
+		t.Fatal("expected baseline and relative reads not to record samples")
+	}
+}
+
+var allocSink []byte
+
+func allocatingWorkload() {
+	for i := 0; i < 200000; i++ {
+		allocSink = make([]byte, 1024)
+	}
+}
+
+func TestSetGCPercent(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	original := p.SetGCPercent(250)
+	defer p.SetGCPercent(original)
+
+	if previous := p.SetGCPercent(original); previous != 250 {
+		t.Fatalf("expected previous GOGC of 250, got %d", previous)
+	}
+}
+
+func TestCompareGCPercent(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	original := p.SetGCPercent(100)
+	p.SetGCPercent(original)
+
+	results := p.CompareGCPercent([]int{100, 400}, allocatingWorkload)
+	if len(results) != 2 {
+		t.Fatalf("expected 2 comparisons, got %d", len(results))
+	}
+	if results[0].GCPercent != 100 || results[1].GCPercent != 400 {
+		t.Fatalf("unexpected candidates: %+v", results)
+	}
+	if results[1].NumGC >= results[0].NumGC {
+		t.Fatalf("expected fewer GCs at GOGC=400 (%d) than GOGC=100 (%d)", results[1].NumGC, results[0].NumGC)
+	}
+	if results[0].PeakHeapInuse == 0 {
+		t.Fatal("expected non-zero peak HeapInuse")
+	}
+
+	if restored := p.SetGCPercent(original); restored != original {
+		t.Fatalf("expected GOGC restored to %d, got %d", original, restored)
+	}
+	if n := len(p.Samples()); n != 0 {
+		t.Fatalf("comparison should not record samples, got %d", n)
+	}
+}
+
+func TestGCBeforeSample(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	// Keep garbage on the heap until a GC is forced
+	original := p.SetGCPercent(-1)
+	defer p.SetGCPercent(original)
+
+	makeGarbage := func() {
+		for i := 0; i < 100000; i++ {
+			allocSink = make([]byte, 64)
+		}
+		allocSink = nil
+	}
+
+	makeGarbage()
+	withoutGC := p.GetMemoryStats()
+
+	p.SetGCBeforeSample(true)
+	makeGarbage()
+	withGC := p.GetMemoryStats()
+
+	if withGC.HeapObjects >= withoutGC.HeapObjects {
+		t.Fatalf("expected fewer heap objects with GC before sampling: %d with, %d without",
+			withGC.HeapObjects, withoutGC.HeapObjects)
+	}
+	if withGC.NumGC <= withoutGC.NumGC {
+		t.Fatalf("expected a forced GC before the sample, NumGC %d -> %d", withoutGC.NumGC, withGC.NumGC)
+	}
+}
+
+func TestForceGCCompletesCycles(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	// Garbage for the forced cycles to reclaim
+	for i := 0; i < 64; i++ {
+		allocSink = make([]byte, 1<<20)
+	}
+	allocSink = nil
+
+	for i := 0; i < 20; i++ {
+		var before runtime.MemStats
+		runtime.ReadMemStats(&before)
+
+		result := p.ForceGC()
+		if result.Cycles < 2 {
+			t.Fatalf("expected both forced cycles to complete before returning, got %d", result.Cycles)
+		}
+
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+		if after.NumGC < before.NumGC+2 {
+			t.Fatalf("NumGC increased by %d, expected at least 2", after.NumGC-before.NumGC)
+		}
+	}
+}
+
+func TestForceGCDoesNotRecordSamples(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	p.GetMemoryStats()
+
+	before := len(p.Samples())
+	result := p.ForceGC()
+	if after := len(p.Samples()); after != before {
+		t.Fatalf("ForceGC changed sample count: %d -> %d", before, after)
+	}
+	if result.AfterMB <= 0 || result.GCDuration <= 0 {
+		t.Fatalf("unexpected GC result: %+v", result)
+	}
+}
+
+func TestLeakMonitorHysteresis(t *testing.T) {
+	m := NewLeakMonitor(NewGoMemoryProfiler(100), 3, 2)
+
+	// Oscillating verdicts never reach three consecutive leaks
+	for i, isLeak := range []bool{true, false, true, true, false, true, true, false} {
+		if state := m.record(isLeak); state != LeakStateHealthy {
+			t.Fatalf("verdict %d: expected healthy while oscillating, got %s", i, state)
+		}
+	}
+
+	steps := []struct {
+		isLeak bool
+		want   LeakState
+	}{
+		{true, LeakStateHealthy},
+		{true, LeakStateHealthy},
+		{true, LeakStateLeaking},
+		{false, LeakStateLeaking},
+		{true, LeakStateLeaking},
+		{false, LeakStateLeaking},
+		{false, LeakStateHealthy},
+	}
+	for i, step := range steps {
+		if state := m.record(step.isLeak); state != step.want {
+			t.Fatalf("step %d: expected %s, got %s", i, step.want, state)
+		}
+	}
+	if m.State() != LeakStateHealthy {
+		t.Fatalf("expected final state healthy, got %s", m.State())
+	}
+}
+
+func TestLeakMonitorObserve(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	m := NewLeakMonitor(p, 2, 2)
+
+	// Too few samples leaves the state untouched
+	addSamples(p, linearSeries(3, 1000, 10<<20, 4<<20)...)
+	if state := m.Observe(); state != LeakStateHealthy {
+		t.Fatalf("expected healthy with insufficient data, got %s", state)
+	}
+
+	p.Reset()
+	for i, stats := range linearSeries(6, 1000, 10<<20, 4<<20) {
+		addSamples(p, stats)
+		state := m.Observe()
+		if i == 5 && state != LeakStateLeaking {
+			t.Fatalf("expected leaking after two consecutive leak verdicts, got %s", state)
+		}
+	}
+}
+
+func TestPauseHistory(t *testing.T) {
+	var ring [256]uint64
+	for i := range ring {
+		ring[i] = uint64(i)
+	}
+
+	// Fewer GCs than the ring size: entries 0..numGC-1 in order
+	if got := pauseHistory(ring, 3); len(got) != 3 || got[0] != 0 || got[2] != 2 {
+		t.Fatalf("unexpected short history: %v", got)
+	}
+
+	// Wrapped ring: oldest entry follows the most recent one
+	got := pauseHistory(ring, 300)
+	if len(got) != 256 {
+		t.Fatalf("expected 256 entries, got %d", len(got))
+	}
+	if got[0] != 300%256 || got[255] != (300-1)%256 {
+		t.Fatalf("unexpected wrapped order: first=%d last=%d", got[0], got[255])
+	}
+}
+
+func TestPauseOutliers(t *testing.T) {
+	// 40 cycles of ~200µs pauses with a single 300ms stall
+	var ring [256]uint64
+	for i := 0; i < 40; i++ {
+		ring[i] = uint64(200+i%7) * 1000
+	}
+	ring[23] = 300 * uint64(time.Millisecond)
+
+	outliers := pauseOutliers(pauseHistory(ring, 40), 10)
+	if len(outliers) != 1 || outliers[0] != 300*uint64(time.Millisecond) {
+		t.Fatalf("expected only the 300ms pause, got %v", outliers)
+	}
+
+	if got := pauseOutliers(nil, 10); got != nil {
+		t.Fatalf("expected no outliers without pauses, got %v", got)
+	}
+	if got := NewGoMemoryProfiler(100).DetectPauseOutliers(math.Inf(1)); len(got) != 0 {
+		t.Fatalf("expected no pause to exceed an infinite factor, got %v", got)
+	}
+}
+
+func TestGCPauseHistogram(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	before := len(pauseHistory(m.PauseNs, m.NumGC))
+
+	for i := 0; i < 5; i++ {
+		runtime.GC()
+	}
+
+	pauses := p.GCPauseHistogram()
+	if len(pauses) < before+5 && len(pauses) != 256 {
+		t.Fatalf("expected at least %d pauses, got %d", before+5, len(pauses))
+	}
+
+	nonZero := 0
+	for _, pause := range pauses[len(pauses)-5:] {
+		if pause > 0 {
+			nonZero++
+		}
+	}
+	if nonZero != 5 {
+		t.Fatalf("expected 5 non-zero recent pauses, got %d", nonZero)
+	}
+
+	summary := p.GCPauseStats()
+	if summary.Count < 5 || summary.MinNs > summary.MaxNs || summary.P99Ns > summary.MaxNs {
+		t.Fatalf("inconsistent pause summary: %+v", summary)
+	}
+}
+
+func TestRunMonitor(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	var buf bytes.Buffer
+	if err := runMonitor(&buf, p, time.Millisecond, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %d: %q", len(lines), buf.String())
+	}
+	for i, line := range lines {
+		var stats MemoryStats
+		if err := json.Unmarshal([]byte(line), &stats); err != nil {
+			t.Fatalf("line %d is not valid JSON: %v", i, err)
+		}
+		if stats.Timestamp == 0 {
+			t.Fatalf("line %d has no timestamp", i)
+		}
+	}
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "samples.ndjson")
+	sink, err := NewFileSink(path, 4096, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	p := NewGoMemoryProfiler(100)
+	if err := runMonitor(sink, p, 0, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{path, path + ".1"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("expected %s to exist: %v", name, err)
+		}
+		if info.Size() > 4096 {
+			t.Fatalf("%s exceeds the size limit: %d bytes", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected at most 2 backups, stat .3: %v", err)
+	}
+
+	// Every rotated file holds whole NDJSON records
+	data, err := os.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var stats MemoryStats
+		if err := json.Unmarshal([]byte(line), &stats); err != nil {
+			t.Fatalf("invalid record in backup: %v", err)
+		}
+	}
+}
+
+func TestFileSinkRotationFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "samples.ndjson")
+	sink, err := NewFileSink(path, 16, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	// A directory where the second backup belongs makes shifting path.1 fail
+	if err := os.WriteFile(path+".1", []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	blocker := path + ".2"
+	if err := os.MkdirAll(filepath.Join(blocker, "busy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	record := []byte("0123456789abcdef\n")
+	if _, err := sink.Write(record); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sink.Write(record); err == nil {
+		t.Fatal("expected the blocked rotation to fail")
+	}
+
+	if err := os.RemoveAll(blocker); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sink.Write(record); err != nil {
+		t.Fatalf("expected writes to resume after a failed rotation, got %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(record) {
+		t.Fatalf("expected the new file to hold the latest record, got %q", data)
+	}
+}
+
+func TestSampleSink(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	var buf bytes.Buffer
+	p.SetSampleSink(&buf)
+
+	p.StartSampling(5 * time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for len(p.Samples()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	p.StopSampling()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(p.Samples()) {
+		t.Fatalf("expected one sink line per sample, got %d lines for %d samples", len(lines), len(p.Samples()))
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want cliOptions
+	}{
+		{
+			name: "bare command",
+			args: []string{"stats"},
+			want: cliOptions{Command: "stats", MaxSamples: 100, Interval: time.Second, Duration: 30 * time.Second, Profile: "cpu.pprof", RotateBackups: 1},
+		},
+		{
+			name: "bare command with flags",
+			args: []string{"monitor", "-interval", "250ms", "-count", "3"},
+			want: cliOptions{Command: "monitor", MaxSamples: 100, Interval: 250 * time.Millisecond, Count: 3, Duration: 30 * time.Second, Profile: "cpu.pprof", RotateBackups: 1},
+		},
+		{
+			name: "cmd flag",
+			args: []string{"-cmd", "leaks", "-max-samples", "20", "-output", "out.json"},
+			want: cliOptions{Command: "leaks", MaxSamples: 20, Interval: time.Second, Duration: 30 * time.Second, Profile: "cpu.pprof", RotateBackups: 1, Output: "out.json"},
+		},
+		{
+			name: "flags before bare command",
+			args: []string{"-duration", "5s", "cpu"},
+			want: cliOptions{Command: "cpu", MaxSamples: 100, Interval: time.Second, Duration: 5 * time.Second, Profile: "cpu.pprof", RotateBackups: 1},
+		},
+		{
+			name: "human output",
+			args: []string{"stats", "-human"},
+			want: cliOptions{Command: "stats", MaxSamples: 100, Interval: time.Second, Duration: 30 * time.Second, Profile: "cpu.pprof", Human: true, RotateBackups: 1},
+		},
+		{
+			name: "compact output",
+			args: []string{"gc", "-compact"},
+			want: cliOptions{Command: "gc", MaxSamples: 100, Interval: time.Second, Duration: 30 * time.Second, Profile: "cpu.pprof", Compact: true, RotateBackups: 1},
+		},
+		{
+			name: "output rotation",
+			args: []string{"monitor", "-output", "soak.ndjson", "-rotate-bytes", "1048576", "-rotate-backups", "5"},
+			want: cliOptions{Command: "monitor", MaxSamples: 100, Interval: time.Second, Duration: 30 * time.Second, Profile: "cpu.pprof", Output: "soak.ndjson", RotateBytes: 1 << 20, RotateBackups: 5},
+		},
+		{
+			name: "cmd flag wins over bare command",
+			args: []string{"stats", "-cmd", "gc"},
+			want: cliOptions{Command: "gc", MaxSamples: 100, Interval: time.Second, Duration: 30 * time.Second, Profile: "cpu.pprof", RotateBackups: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseArgs(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseArgsInvalidFlag(t *testing.T) {
+	if _, err := parseArgs([]string{"stats", "-interval", "soon"}); err == nil {
+		t.Fatal("expected error for invalid duration")
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	profile := filepath.Join(t.TempDir(), "cpu.pprof")
+	tests := []struct {
+		command string
+		key     string // A field every result for the command includes
+	}{
+		{"stats", "data"},
+		{"leaks", "data"},
+		{"gc", "data"},
+		{"release", "data"},
+		{"cpu", "data"},
+		{"monitor", "heapInuse"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			p := NewGoMemoryProfiler(100)
+			p.SetClock(newFakeClock())
+			opts := cliOptions{
+				Command:  tt.command,
+				Interval: time.Second,
+				Count:    1,
+				Duration: 10 * time.Millisecond,
+				Profile:  profile,
+			}
+
+			var buf bytes.Buffer
+			if err := runCommand(&buf, p, opts); err != nil {
+				t.Fatal(err)
+			}
+
+			var result map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+				t.Fatalf("invalid JSON output: %v\n%s", err, buf.String())
+			}
+			if _, ok := result[tt.key]; !ok {
+				t.Fatalf("expected %q in output, got %s", tt.key, buf.String())
+			}
+		})
+	}
+
+	if err := runCommand(io.Discard, NewGoMemoryProfiler(100), cliOptions{Command: "bogus"}); err == nil {
+		t.Fatal("expected error for unknown command")
+	}
+}
+
+func TestCompactOutput(t *testing.T) {
+	for _, command := range []string{"stats", "gc", "release", "monitor"} {
+		t.Run(command, func(t *testing.T) {
+			p := NewGoMemoryProfiler(100)
+			p.SetClock(newFakeClock())
+			opts := cliOptions{Command: command, Interval: time.Second, Count: 2, Compact: true}
+
+			var buf bytes.Buffer
+			if err := runCommand(&buf, p, opts); err != nil {
+				t.Fatal(err)
+			}
+
+			records := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			if command == "monitor" && len(records) != 2 {
+				t.Fatalf("expected one line per monitor sample, got %d", len(records))
+			} else if command != "monitor" && len(records) != 1 {
+				t.Fatalf("expected a single-line record, got:\n%s", buf.String())
+			}
+			for _, record := range records {
+				if !json.Valid([]byte(record)) {
+					t.Fatalf("invalid JSON record: %s", record)
+				}
+			}
+		})
+	}
+}
+
+func TestHumanizeBytes(t *testing.T) {
+	tests := []struct {
+		bytes uint64
+		want  string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536 << 10, "1.5 MiB"},
+		{512 << 20, "512.0 MiB"},
+		{1 << 30, "1.0 GiB"},
+		{1<<40 - 1, "1024.0 GiB"},
+		{1 << 40, "1.0 TiB"},
+		{3 << 40, "3.0 TiB"},
+	}
+	for _, tt := range tests {
+		if got := humanizeBytes(tt.bytes); got != tt.want {
+			t.Errorf("humanizeBytes(%d) = %q, want %q", tt.bytes, got, tt.want)
+		}
+	}
+}
+
+func TestHumanOutput(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	p.AddSyntheticSample(MemoryStats{Timestamp: 1000, HeapAlloc: 1 << 30, HeapObjects: 2048})
+
+	var buf bytes.Buffer
+	if err := writeEnvelope(&buf, outputFormat{Human: true}, "stats", p.Samples()[0].Stats); err != nil {
+		t.Fatal(err)
+	}
+
+	var envelope struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if got := envelope.Data["heapAlloc"]; got != "1.0 GiB" {
+		t.Fatalf("expected humanized heapAlloc, got %v", got)
+	}
+	if got := envelope.Data["heapObjects"]; got != float64(2048) {
+		t.Fatalf("expected object counts to stay numeric, got %v", got)
+	}
+}
+
+func TestRunLeaksUsesInterval(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	p.SetClock(newFakeClock())
+
+	var buf bytes.Buffer
+	if err := runLeaks(&buf, p, outputFormat{}, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	var envelope struct {
+		Data LeakDetectionResult `json:"data"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Data.Status != "analyzed" || envelope.Data.DurationSeconds != 8 {
+		t.Fatalf("expected five samples 2s apart, got %+v", envelope.Data)
+	}
+}
+
+func TestWriteEnvelope(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	addSamples(p, linearSeries(5, 1000, 10<<20, 1<<20)...)
+
+	outputs := map[string]interface{}{
+		"stats":   p.GetMemoryStats(),
+		"leaks":   p.DetectMemoryLeaks(),
+		"gc":      p.ForceGC(),
+		"release": p.ReleaseToOS(),
+		"cpu":     CPUProfileResult{Path: "cpu.pprof", DurationMs: 10},
+	}
+	for kind, data := range outputs {
+		var buf bytes.Buffer
+		if err := writeEnvelope(&buf, outputFormat{}, kind, data); err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+
+		var envelope map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &envelope); err != nil {
+			t.Fatalf("%s: invalid JSON: %v", kind, err)
+		}
+		if version, ok := envelope["schemaVersion"].(float64); !ok || version != schemaVersion {
+			t.Fatalf("%s: expected numeric schemaVersion, got %v", kind, envelope["schemaVersion"])
+		}
+		if envelope["type"] != kind {
+			t.Fatalf("expected type %q, got %v", kind, envelope["type"])
+		}
+		if _, ok := envelope["data"].(map[string]interface{}); !ok {
+			t.Fatalf("%s: expected object data, got %v", kind, envelope["data"])
+		}
+	}
+}
+
+func TestAllocationRates(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	first := p.recordSample(MemoryStats{Timestamp: 1000, TotalAlloc: 10 << 20, Mallocs: 1000})
+	if first.AllocRateBytesPerSec != 0 || first.MallocRatePerSec != 0 {
+		t.Fatalf("expected zero rates for the first sample, got %+v", first)
+	}
+
+	second := p.recordSample(MemoryStats{Timestamp: 3000, TotalAlloc: 14 << 20, Mallocs: 5000})
+	if second.AllocRateBytesPerSec != 2<<20 {
+		t.Fatalf("expected 2MB/sec allocation rate, got %v", second.AllocRateBytesPerSec)
+	}
+	if second.MallocRatePerSec != 2000 {
+		t.Fatalf("expected 2000 mallocs/sec, got %v", second.MallocRatePerSec)
+	}
+
+	if stored := p.Samples()[1].Stats; stored.AllocRateBytesPerSec != second.AllocRateBytesPerSec {
+		t.Fatalf("retained sample is missing the derived rate: %+v", stored)
+	}
+}
+
+func TestGCHeadroom(t *testing.T) {
+	tests := []struct {
+		name      string
+		nextGC    uint64
+		heapAlloc uint64
+		want      GCHeadroomReport
+	}{
+		{"quarter used", 64 << 20, 16 << 20, GCHeadroomReport{NextGC: 64 << 20, HeapAlloc: 16 << 20, RemainingBytes: 48 << 20, FractionUsed: 0.25}},
+		{"past target", 64 << 20, 80 << 20, GCHeadroomReport{NextGC: 64 << 20, HeapAlloc: 80 << 20, FractionUsed: 1.25}},
+		{"no target", 0, 16 << 20, GCHeadroomReport{HeapAlloc: 16 << 20}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewGoMemoryProfiler(100)
+			addSamples(p, MemoryStats{Timestamp: 1000, NextGC: tt.nextGC, HeapAlloc: tt.heapAlloc})
+
+			if got := p.GCHeadroom(); got != tt.want {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestEstimateTimeToLimit(t *testing.T) {
+	// 1MB/sec from 100MB, ending at 109MB
+	p := NewGoMemoryProfiler(100)
+	addSamples(p, linearSeries(10, 1000, 100<<20, 1<<20)...)
+
+	eta, err := p.EstimateTimeToLimit(200 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eta < 90*time.Second || eta > 92*time.Second {
+		t.Fatalf("expected about 91s to reach 200MB, got %s", eta)
+	}
+
+	if eta, err := p.EstimateTimeToLimit(100 << 20); err != nil || eta != 0 {
+		t.Fatalf("expected 0 when already past the limit, got %s, %v", eta, err)
+	}
+
+	flat := NewGoMemoryProfiler(100)
+	addSamples(flat, linearSeries(10, 1000, 100<<20, 0)...)
+	if _, err := flat.EstimateTimeToLimit(200 << 20); !errors.Is(err, ErrNoGrowth) {
+		t.Fatalf("expected ErrNoGrowth for a flat trend, got %v", err)
+	}
+
+	if _, err := NewGoMemoryProfiler(100).EstimateTimeToLimit(200 << 20); err == nil {
+		t.Fatal("expected an error without samples")
+	}
+}
+
+func TestRuntimeOverhead(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	p.AddSyntheticSample(MemoryStats{
+		Timestamp:   1000,
+		HeapSys:     500 << 20,
+		MSpanSys:    1 << 20,
+		MCacheSys:   2 << 20,
+		BuckHashSys: 3 << 20,
+		GCSys:       4 << 20,
+		OtherSys:    5 << 20,
+		StackSys:    6 << 20,
+	})
+
+	if got := p.RuntimeOverhead(); got != 21<<20 {
+		t.Fatalf("expected 21MB of runtime overhead, got %d", got)
+	}
+	if got := p.Samples()[0].Stats.RuntimeOverhead; got != 21<<20 {
+		t.Fatalf("expected the derived field on the sample, got %d", got)
+	}
+
+	if stats := NewGoMemoryProfiler(100).GetMemoryStats(); stats.RuntimeOverhead == 0 || stats.RuntimeOverhead > stats.Sys {
+		t.Fatalf("expected live overhead within Sys, got %d of %d", stats.RuntimeOverhead, stats.Sys)
+	}
+}
+
+func TestFragmentationReport(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	addSamples(p, MemoryStats{
+		HeapSys:      100 << 20,
+		HeapIdle:     80 << 20,
+		HeapReleased: 10 << 20,
+	})
+
+	report := p.FragmentationReport()
+	if report.RetainedIdleBytes != 70<<20 {
+		t.Fatalf("expected 70MB retained idle, got %d", report.RetainedIdleBytes)
+	}
+	if report.Ratio != 0.7 {
+		t.Fatalf("expected ratio 0.7, got %v", report.Ratio)
+	}
+	if !report.IsHighFragmentation || report.Suggestion == "" {
+		t.Fatalf("expected high fragmentation with a suggestion: %+v", report)
+	}
+
+	p.SetFragmentationThreshold(0.8)
+	if report := p.FragmentationReport(); report.IsHighFragmentation {
+		t.Fatalf("ratio below configured threshold should not be flagged: %+v", report)
+	}
+}
+
+func TestChurnReport(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	// 500k objects allocated and freed per second on a flat heap
+	stats := make([]MemoryStats, 5)
+	for i := range stats {
+		stats[i] = MemoryStats{
+			Timestamp:     int64(i) * 1000,
+			HeapInuse:     50 << 20,
+			Mallocs:       uint64(i) * 500000,
+			Frees:         uint64(i)*500000 - uint64(i)*100,
+			GCCPUFraction: 0.2,
+		}
+	}
+	addSamples(p, stats...)
+
+	report := p.ChurnReport()
+	if !report.IsHighChurn {
+		t.Fatalf("expected high churn on a flat heap: %+v", report)
+	}
+	if report.MallocRatePerSec != 500000 || report.NetObjects != 400 {
+		t.Fatalf("unexpected rates: %+v", report)
+	}
+	if report.GCCPUFraction != 0.2 {
+		t.Fatalf("expected GC CPU fraction from the latest sample, got %v", report.GCCPUFraction)
+	}
+
+	p.SetChurnThreshold(1000000)
+	if report := p.ChurnReport(); report.IsHighChurn {
+		t.Fatalf("malloc rate below configured threshold should not be flagged: %+v", report)
+	}
+
+	if report := NewGoMemoryProfiler(100).ChurnReport(); report.Status != "insufficient_data" {
+		t.Fatalf("expected insufficient_data without samples, got %+v", report)
+	}
+}
+
+func TestMeasureAllocs(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	original := p.SetGCPercent(100)
+	defer p.SetGCPercent(original)
+
+	m := p.MeasureAllocs(func() {
+		allocSink = make([]byte, 4096)
+	})
+	allocSink = nil
+
+	if m.Runs != allocMeasureRuns {
+		t.Fatalf("expected %d runs, got %d", allocMeasureRuns, m.Runs)
+	}
+	if m.BytesPerCall < 4096 || m.BytesPerCall > 4200 {
+		t.Fatalf("expected ~4096 bytes per call, got %v", m.BytesPerCall)
+	}
+	if m.AllocsPerCall < 1 || m.AllocsPerCall > 1.1 {
+		t.Fatalf("expected ~1 allocation per call, got %v", m.AllocsPerCall)
+	}
+	if got := p.SetGCPercent(100); got != 100 {
+		t.Fatalf("expected GC percent to be restored to 100, got %d", got)
+	}
+}
+
+func TestReleaseToOS(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	allocSink = make([]byte, 64<<20)
+	for i := range allocSink {
+		allocSink[i] = byte(i)
+	}
+	allocSink = nil
+
+	result := p.ReleaseToOS()
+	if result.ReleasedMB <= 0 {
+		t.Fatalf("expected HeapReleased to increase, got %+v", result)
+	}
+	if result.AfterReleasedMB <= result.BeforeReleasedMB {
+		t.Fatalf("expected after > before: %+v", result)
+	}
+}
+
+// openWebSocket completes a WebSocket handshake with server and returns the
+// connection and a reader positioned after the 101 response
+func openWebSocket(t *testing.T, server *httptest.Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+	// Example accept value from RFC 6455 section 1.3
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected accept value %q", accept)
+	}
+	return conn, reader
+}
+
+func TestServeWebSocket(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	p.SetStreamInterval(5 * time.Millisecond)
+
+	handlerDone := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(handlerDone)
+		p.ServeWebSocket(w, r)
+	}))
+	defer server.Close()
+
+	conn, reader := openWebSocket(t, server)
+	defer conn.Close()
+
+	for i := 0; i < 3; i++ {
+		opcode, payload, err := readWebSocketFrame(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opcode != wsOpText {
+			t.Fatalf("frame %d: expected text frame, got opcode %d", i, opcode)
+		}
+		var stats MemoryStats
+		if err := json.Unmarshal(payload, &stats); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if stats.Timestamp == 0 {
+			t.Fatalf("frame %d has no timestamp", i)
+		}
+	}
+
+	// Masked close frame with an empty payload
+	if _, err := conn.Write([]byte{0x80 | wsOpClose, 0x80, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-handlerDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler did not exit after client close")
+	}
+}
+
+func TestServeWebSocketOversizedFrame(t *testing.T) {
+	tests := []struct {
+		name   string
+		frame  []byte
+		status uint16
+	}{
+		// Masked text frame claiming a 2^63-1 byte payload
+		{"data frame", []byte{0x80 | wsOpText, 0x80 | 127, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}, wsCloseTooBig},
+		// Masked close frame claiming a 126 byte payload
+		{"control frame", []byte{0x80 | wsOpClose, 0x80 | 126, 0, 126, 0, 0, 0, 0}, wsCloseProtocolError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewGoMemoryProfiler(100)
+			p.SetStreamInterval(5 * time.Millisecond)
+
+			handlerDone := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer close(handlerDone)
+				p.ServeWebSocket(w, r)
+			}))
+			defer server.Close()
+
+			conn, reader := openWebSocket(t, server)
+			defer conn.Close()
+			if _, err := conn.Write(tt.frame); err != nil {
+				t.Fatal(err)
+			}
+
+			for {
+				opcode, payload, err := readWebSocketFrame(reader)
+				if err != nil {
+					t.Fatalf("expected a close frame, got %v", err)
+				}
+				if opcode != wsOpClose {
+					continue
+				}
+				if len(payload) != 2 || binary.BigEndian.Uint16(payload) != tt.status {
+					t.Fatalf("expected close status %d, got %v", tt.status, payload)
+				}
+				break
+			}
+
+			select {
+			case <-handlerDone:
+			case <-time.After(2 * time.Second):
+				t.Fatal("handler did not exit after refusing the frame")
+			}
+		})
+	}
+}
+
+func TestServeWebSocketRequiresUpgrade(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	rec := httptest.NewRecorder()
+	p.ServeWebSocket(rec, httptest.NewRequest("GET", "/", nil))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without upgrade headers, got %d", rec.Code)
+	}
+}
+
+func TestDetectMemoryLeaksSmoothed(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	p.LeakMetric = MetricAlloc
+
+	// GC sawtooth: Alloc climbs between collections and drops back, with no
+	// underlying growth
+	sawtooth := []uint64{10 << 20, 20 << 20, 30 << 20}
+	for i := 0; i < 12; i++ {
+		p.recordSample(MemoryStats{Timestamp: int64(i) * 1000, Alloc: sawtooth[i%3]})
+	}
+
+	if raw := p.DetectMemoryLeaks(); !raw.IsLeakDetected {
+		t.Fatalf("expected raw detection to false-positive on the sawtooth, got %+v", raw)
+	}
+	smoothed := p.DetectMemoryLeaksSmoothed()
+	if smoothed.IsLeakDetected {
+		t.Fatalf("smoothed detection flagged a sawtooth: %+v", smoothed)
+	}
+	if smoothed.Status != "analyzed" {
+		t.Fatalf("expected analyzed status, got %q", smoothed.Status)
+	}
+}
+
+func TestDetectMemoryLeaksSmoothedSteadyClimb(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	p.SetSmoothingFactor(0.5)
+	for _, stats := range linearSeries(20, 1000, 10<<20, 4<<20) {
+		p.recordSample(stats)
+	}
+
+	if result := p.DetectMemoryLeaksSmoothed(); !result.IsLeakDetected {
+		t.Fatalf("expected smoothed detection to catch a steady climb, got %+v", result)
+	}
+}
+
+func TestSessionManager(t *testing.T) {
+	m := NewSessionManager(50)
+
+	api := m.Session("api")
+	worker := m.Session("worker")
+	if m.Session("api") != api {
+		t.Fatal("expected Session to return the existing profiler")
+	}
+
+	for i := 0; i < 3; i++ {
+		api.GetMemoryStats()
+	}
+	worker.GetMemoryStats()
+
+	if n := len(api.Samples()); n != 3 {
+		t.Fatalf("expected 3 api samples, got %d", n)
+	}
+	if n := len(worker.Samples()); n != 1 {
+		t.Fatalf("expected 1 worker sample, got %d", n)
+	}
+
+	if names := m.Sessions(); len(names) != 2 || names[0] != "api" || names[1] != "worker" {
+		t.Fatalf("unexpected sessions: %v", names)
+	}
+
+	m.RemoveSession("api")
+	if names := m.Sessions(); len(names) != 1 || names[0] != "worker" {
+		t.Fatalf("unexpected sessions after removal: %v", names)
+	}
+	if m.Session("api") == api {
+		t.Fatal("expected a fresh profiler after removal")
+	}
+}
+
+func TestCompareToBaseline(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	baseline := MemoryStats{HeapInuse: 100 << 20, HeapObjects: 10000, TotalAlloc: 500 << 20}
+	addSamples(p, MemoryStats{HeapInuse: 120 << 20, HeapObjects: 10500, TotalAlloc: 500 << 20})
+
+	result := p.CompareToBaseline(baseline, 10)
+	if !result.Regressed {
+		t.Fatalf("expected regression at 20%% over baseline: %+v", result)
+	}
+	if len(result.Exceeded) != 1 || result.Exceeded[0] != "heapInuse" {
+		t.Fatalf("expected only heapInuse to exceed tolerance, got %v", result.Exceeded)
+	}
+	if got := result.Metrics[0].ChangePercent; got != 20 {
+		t.Fatalf("expected 20%% heapInuse change, got %v", got)
+	}
+
+	if result := p.CompareToBaseline(baseline, 25); result.Regressed {
+		t.Fatalf("expected no regression within 25%% tolerance: %+v", result)
+	}
+}
+
+func sessionSeries(heapInuse uint64, goroutines int, pausePerSec, allocPerSec uint64) []MemoryStats {
+	stats := make([]MemoryStats, 10)
+	for i := range stats {
+		stats[i] = MemoryStats{
+			Timestamp:    int64(i) * 1000,
+			HeapInuse:    heapInuse,
+			Goroutines:   goroutines,
+			PauseTotalNs: uint64(i) * pausePerSec,
+			TotalAlloc:   uint64(i) * allocPerSec,
+		}
+	}
+	return stats
+}
+
+func TestCompareSessions(t *testing.T) {
+	before := NewGoMemoryProfiler(100)
+	addSamples(before, sessionSeries(100<<20, 10, 1000000, 10<<20)...)
+	after := NewGoMemoryProfiler(100)
+	addSamples(after, sessionSeries(80<<20, 20, 1020000, 20<<20)...)
+
+	comparison := CompareSessions(before, after)
+	if comparison.Status != "analyzed" {
+		t.Fatalf("expected analyzed comparison, got %+v", comparison)
+	}
+
+	want := map[string]string{
+		"heapInuseP50":         VerdictImproved,
+		"heapInuseP99":         VerdictImproved,
+		"peakGoroutines":       VerdictRegressed,
+		"totalGCPauseNs":       VerdictUnchanged,
+		"allocRateBytesPerSec": VerdictRegressed,
+	}
+	if len(comparison.Dimensions) != len(want) {
+		t.Fatalf("expected %d dimensions, got %+v", len(want), comparison.Dimensions)
+	}
+	for _, dim := range comparison.Dimensions {
+		if dim.Verdict != want[dim.Name] {
+			t.Fatalf("%s: expected %s, got %+v", dim.Name, want[dim.Name], dim)
+		}
+	}
+	if dim := comparison.Dimensions[2]; dim.Before != 10 || dim.After != 20 || dim.Delta != 10 || dim.ChangePercent != 100 {
+		t.Fatalf("unexpected goroutine deltas: %+v", dim)
+	}
+
+	if result := CompareSessions(before, NewGoMemoryProfiler(100)); result.Status != "insufficient_data" {
+		t.Fatalf("expected insufficient_data against an empty session, got %+v", result)
+	}
+}
+
+func TestSteadyStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "steady.json")
+
+	previous := NewGoMemoryProfiler(100)
+	addSamples(previous, linearSeries(20, 1000, 100<<20, 0)...)
+	if err := previous.RecordSteadyState(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same usage on the next run is unchanged
+	comparison, err := previous.CompareSteadyState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comparison.Regressed {
+		t.Fatalf("expected no regression against itself, got %+v", comparison)
+	}
+
+	current := NewGoMemoryProfiler(100)
+	addSamples(current, linearSeries(20, 1000, 120<<20, 0)...)
+	comparison, err = current.CompareSteadyState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !comparison.Regressed {
+		t.Fatalf("expected a regression, got %+v", comparison)
+	}
+	if comparison.Previous.HeapInuse.P50 != 100<<20 || comparison.Current.HeapInuse.P50 != 120<<20 {
+		t.Fatalf("unexpected p50s %d and %d", comparison.Previous.HeapInuse.P50, comparison.Current.HeapInuse.P50)
+	}
+	for _, dim := range comparison.Dimensions {
+		if dim.Verdict != VerdictRegressed || math.Abs(dim.ChangePercent-20) > 1e-9 {
+			t.Fatalf("expected %s to regress by 20%%, got %+v", dim.Name, dim)
+		}
+	}
+
+	if err := NewGoMemoryProfiler(100).RecordSteadyState(path); err == nil {
+		t.Fatal("expected an error recording without samples")
+	}
+	if _, err := current.CompareSteadyState(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Fatal("expected an error for a missing state file")
+	}
+
+	future := filepath.Join(t.TempDir(), "future.json")
+	if err := os.WriteFile(future, []byte(`{"schemaVersion": 2, "sampleCount": 20}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := current.CompareSteadyState(future); err == nil || !strings.Contains(err.Error(), "version 2") {
+		t.Fatalf("expected an unsupported version error, got %v", err)
+	}
+}
+
+func TestStartTwice(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Start(); !errors.Is(err, ErrAlreadyRunning) {
+		t.Fatalf("expected ErrAlreadyRunning, got %v", err)
+	}
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStopWithoutStart(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	if err := p.Stop(); !errors.Is(err, ErrNotRunning) {
+		t.Fatalf("expected ErrNotRunning, got %v", err)
+	}
+
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Stop(); !errors.Is(err, ErrNotRunning) {
+		t.Fatalf("expected ErrNotRunning after stop, got %v", err)
+	}
+}
+
+func TestOnCeilingExceeded(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	p.SetMemoryCeiling(100 << 20)
+
+	var fired []uint64
+	p.OnCeilingExceeded(func(stats MemoryStats) {
+		fired = append(fired, stats.HeapInuse)
+	})
+
+	// Cross, stay above, drop below, cross again
+	for _, mb := range []uint64{50, 120, 130, 110, 90, 80, 150, 100} {
+		addSamples(p, MemoryStats{HeapInuse: mb << 20})
+		p.checkAlerts()
+	}
+
+	if len(fired) != 2 {
+		t.Fatalf("expected 2 ceiling callbacks, got %d", len(fired))
+	}
+	if fired[0] != 120<<20 || fired[1] != 150<<20 {
+		t.Fatalf("callbacks fired on unexpected samples: %v", fired)
+	}
+}
+
+func TestOnAllocRateExceeded(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	p.SetAllocRateBudget(100 << 20)
+
+	var fired []uint64
+	p.OnAllocRateExceeded(func(rate uint64) {
+		fired = append(fired, rate)
+	})
+
+	// Ten seconds at 50MB/s, then 200MB/s until the 10s average crosses
+	var total uint64
+	for i := 0; i < 20; i++ {
+		if i > 10 {
+			total += 200 << 20
+		} else if i > 0 {
+			total += 50 << 20
+		}
+		addSamples(p, MemoryStats{Timestamp: int64(i) * 1000, TotalAlloc: total})
+		p.checkAlerts()
+	}
+
+	if len(fired) != 1 {
+		t.Fatalf("expected 1 callback while over budget, got %d", len(fired))
+	}
+	// Four fast seconds and six slow ones average 110MB/s
+	if fired[0] != 110<<20 {
+		t.Fatalf("expected a rate of %d, got %d", uint64(110<<20), fired[0])
+	}
+}
+
+func TestSetAllocRateWindow(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	p.SetAllocRateBudget(100 << 20)
+	p.SetAllocRateWindow(4 * time.Second)
+
+	var fired []uint64
+	p.OnAllocRateExceeded(func(rate uint64) {
+		fired = append(fired, rate)
+	})
+
+	var total uint64
+	for i := 0; i < 20; i++ {
+		if i > 10 {
+			total += 200 << 20
+		} else if i > 0 {
+			total += 50 << 20
+		}
+		addSamples(p, MemoryStats{Timestamp: int64(i) * 1000, TotalAlloc: total})
+		p.checkAlerts()
+	}
+
+	// The shorter window crosses after two fast seconds, averaging 125MB/s
+	if len(fired) != 1 || fired[0] != 125<<20 {
+		t.Fatalf("expected a single callback at %d, got %v", uint64(125<<20), fired)
+	}
+}
+
+func TestTimestampRFC3339(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	stats := p.GetMemoryStats()
+	parsed, err := time.Parse(time.RFC3339, stats.Time)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.UnixMilli() != stats.Timestamp {
+		t.Fatalf("time %q does not round-trip to %d", stats.Time, stats.Timestamp)
+	}
+
+	if got := formatTimestamp(1700000000123); got != "2023-11-14T22:13:20.123Z" {
+		t.Fatalf("unexpected format: %q", got)
+	}
+}
+
+func TestHealthCritical(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	stats := linearSeries(6, 1000, 10<<20, 4<<20)
+	for i := range stats {
+		stats[i].GCCPUFraction = 0.4
+		stats[i].Goroutines = 10
+	}
+	addSamples(p, stats...)
+
+	report := p.Health()
+	if report.Status != HealthCritical {
+		t.Fatalf("expected critical, got %q: %v", report.Status, report.Issues)
+	}
+	if len(report.Issues) != 2 {
+		t.Fatalf("expected leak and GC issues, got %v", report.Issues)
+	}
+	if !strings.HasPrefix(report.Issues[0], "memory leak") || !strings.HasPrefix(report.Issues[1], "GC pressure") {
+		t.Fatalf("unexpected issues: %v", report.Issues)
+	}
+}
+
+func TestHealthThresholds(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	stats := linearSeries(6, 1000, 10<<20, 0)
+	for i := range stats {
+		stats[i].GCCPUFraction = 0.15
+	}
+	addSamples(p, stats...)
+
+	if report := p.Health(); report.Status != HealthWarning {
+		t.Fatalf("expected warning at default thresholds, got %q: %v", report.Status, report.Issues)
+	}
+
+	p.SetHealthThresholds(HealthThresholds{GCCPUWarning: 0.2, GCCPUCritical: 0.5})
+	if report := p.Health(); report.Status != HealthHealthy || len(report.Issues) != 0 {
+		t.Fatalf("expected healthy with raised thresholds, got %q: %v", report.Status, report.Issues)
+	}
+}
+
+func TestOnGCPauseExceeded(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	p.SetMaxGCPauseThreshold(time.Nanosecond)
+
+	var pauses []uint64
+	p.OnGCPauseExceeded(func(pauseNs uint64) {
+		pauses = append(pauses, pauseNs)
+	})
+
+	// Pauses from cycles before the first check are not reported
+	runtime.GC()
+	p.GetMemoryStats()
+	p.checkAlerts()
+	if len(pauses) != 0 {
+		t.Fatalf("expected earlier pauses to be skipped, got %v", pauses)
+	}
+
+	// A real GC always pauses for longer than 1ns
+	runtime.GC()
+	p.GetMemoryStats()
+	p.checkAlerts()
+	if len(pauses) != 1 || pauses[0] == 0 {
+		t.Fatalf("expected one pause callback after a forced GC, got %v", pauses)
+	}
+
+	// No new GC cycle: the same pause is not reported twice
+	p.checkAlerts()
+	if len(pauses) != 1 {
+		t.Fatalf("expected pause to be reported once, got %v", pauses)
+	}
+
+	// Simulated slow pause on a later cycle
+	p.SetMaxGCPauseThreshold(50 * time.Millisecond)
+	last := p.Samples()[len(p.Samples())-1].Stats
+	addSamples(p, MemoryStats{NumGC: last.NumGC + 1, PauseNs: uint64(10 * time.Millisecond)})
+	p.checkAlerts()
+	addSamples(p, MemoryStats{NumGC: last.NumGC + 2, PauseNs: uint64(80 * time.Millisecond)})
+	p.checkAlerts()
+
+	if len(pauses) != 2 || pauses[1] != uint64(80*time.Millisecond) {
+		t.Fatalf("expected the 80ms pause to be reported, got %v", pauses)
+	}
+}
+
+func TestBufferStats(t *testing.T) {
+	p := NewGoMemoryProfiler(10)
+	for _, stats := range linearSeries(25, 1000, 10<<20, 0) {
+		p.recordSample(stats)
+	}
+
+	want := BufferStats{TotalSamplesTaken: 25, SamplesEvicted: 15, Retained: 10, Capacity: 10}
+	if got := p.BufferStats(); got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+
+	p.SetMaxSamples(4)
+	if got := p.BufferStats().SamplesEvicted; got != 21 {
+		t.Fatalf("expected shrinking to count 6 more evictions, got %d", got)
+	}
+
+	p.Reset()
+	if got := p.BufferStats(); got.TotalSamplesTaken != 0 || got.SamplesEvicted != 0 {
+		t.Fatalf("expected Reset to clear the counters, got %+v", got)
+	}
+}
+
+func TestRetentionDuration(t *testing.T) {
+	clock := newFakeClock()
+	p := NewGoMemoryProfiler(1000)
+	p.SetClock(clock)
+	p.SetRetentionDuration(10 * time.Minute)
+
+	// One sample every 30s across 15 minutes
+	for i := 0; i <= 30; i++ {
+		if i > 0 {
+			clock.Sleep(30 * time.Second)
+		}
+		p.AddSyntheticSample(MemoryStats{HeapInuse: uint64(i)})
+	}
+
+	samples := p.Samples()
+	cutoff := clock.Now().Add(-10 * time.Minute).UnixMilli()
+	if len(samples) != 21 {
+		t.Fatalf("expected the 21 samples from the last 10 minutes, got %d", len(samples))
+	}
+	for _, sample := range samples {
+		if sample.Stats.Timestamp < cutoff {
+			t.Fatalf("sample at %d is older than the retention cutoff %d", sample.Stats.Timestamp, cutoff)
+		}
+	}
+	if first := samples[0].Stats.HeapInuse; first != 10 {
+		t.Fatalf("expected the oldest retained sample to be from minute 5, got sample %d", first)
+	}
+}
+
+func TestRetentionDurationSampleTimestamps(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	p.SetRetentionDuration(10 * time.Minute)
+
+	// Synthetic timestamps far behind the clock are aged against each other
+	for _, stats := range linearSeries(10, 1000, 10<<20, 1<<20) {
+		stats.Timestamp += 1000
+		p.AddSyntheticSample(stats)
+	}
+	if n := len(p.Samples()); n != 10 {
+		t.Fatalf("expected all 10 synthetic samples retained, got %d", n)
+	}
+
+	// Out of order, only the sample from minute 5 is over 10 minutes older
+	// than the newest at minute 20
+	p.Reset()
+	for _, minute := range []int64{20, 12, 5, 15, 19} {
+		p.AddSyntheticSample(MemoryStats{Timestamp: minute * 60000, HeapInuse: uint64(minute)})
+	}
+	var kept []uint64
+	for _, sample := range p.Samples() {
+		kept = append(kept, sample.Stats.HeapInuse)
+	}
+	if len(kept) != 4 || kept[0] != 20 || kept[1] != 12 || kept[2] != 15 || kept[3] != 19 {
+		t.Fatalf("expected minutes 20, 12, 15 and 19 retained, got %v", kept)
+	}
+	if evicted := p.BufferStats().SamplesEvicted; evicted != 1 {
+		t.Fatalf("expected 1 sample evicted, got %d", evicted)
+	}
+
+	// Loaded samples are aged the same way
+	path := filepath.Join(t.TempDir(), "samples.json")
+	source := NewGoMemoryProfiler(100)
+	for _, minute := range []int64{30, 1, 25} {
+		addSamples(source, MemoryStats{Timestamp: minute * 60000})
+	}
+	if err := source.SaveSamples(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.LoadSamples(path); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(p.Samples()); n != 2 {
+		t.Fatalf("expected the 2 loaded samples within 10 minutes of the newest, got %d", n)
+	}
+}
+
+func TestNewGoMemoryProfilerWithOptions(t *testing.T) {
+	p, err := NewGoMemoryProfilerWithOptions(Options{
+		MaxSamples:               10,
+		LeakThresholdBytesPerSec: 5 << 20,
+		Units:                    UnitGB,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.maxSamples != 10 || p.LeakThresholdBytesPerSec != 5<<20 || p.Units != UnitGB {
+		t.Fatalf("options not applied: maxSamples=%d threshold=%d units=%v", p.maxSamples, p.LeakThresholdBytesPerSec, p.Units)
+	}
+
+	p, err = NewGoMemoryProfilerWithOptions(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.maxSamples != 100 || p.LeakThresholdBytesPerSec != defaultLeakThreshold || p.Units != UnitMB {
+		t.Fatalf("expected defaults for zero options: maxSamples=%d threshold=%d units=%v", p.maxSamples, p.LeakThresholdBytesPerSec, p.Units)
+	}
+
+	p, err = NewGoMemoryProfilerWithOptions(Options{Sampling: true, SampleInterval: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.SampleInterval(); got != 5*time.Millisecond {
+		t.Fatalf("expected the sampler to be running at 5ms, got %v", got)
+	}
+	p.StopSampling()
+}
+
+func TestNewGoMemoryProfilerWithOptionsInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"negative max samples", Options{MaxSamples: -1}},
+		{"negative retention", Options{RetentionDuration: -time.Minute}},
+		{"unknown units", Options{Units: Unit(7)}},
+		{"sampling without interval", Options{Sampling: true}},
+		{"sampling with negative interval", Options{Sampling: true, SampleInterval: -time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewGoMemoryProfilerWithOptions(tt.opts)
+			if !errors.Is(err, ErrInvalidOptions) {
+				t.Fatalf("expected ErrInvalidOptions, got %v", err)
+			}
+			if p != nil {
+				t.Fatal("expected no profiler on error")
+			}
+		})
+	}
+}
+
+func TestClone(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	p.SetLeakThreshold(5 << 20)
+	p.LeakMetric = MetricHeapObjects
+	p.SetAllocRateBudget(100 << 20)
+	p.SetAllocRateWindow(5 * time.Second)
+	p.SetBaseline()
+	addSamples(p, linearSeries(5, 1000, 10<<20, 1<<20)...)
+
+	clone := p.Clone()
+	if clone.baseline != p.baseline || clone.baseline.Timestamp == 0 {
+		t.Fatalf("baseline not copied: %+v", clone.baseline)
+	}
+	if clone.allocRateBudget != 100<<20 || clone.allocRateWindow != 5*time.Second {
+		t.Fatalf("allocation rate budget not copied: budget=%d window=%v", clone.allocRateBudget, clone.allocRateWindow)
+	}
+
+	for i := 0; i < 3; i++ {
+		p.GetMemoryStats()
+	}
+	if n := len(clone.Samples()); n != 5 {
+		t.Fatalf("expected clone to keep 5 samples, got %d", n)
+	}
+	if n := len(p.Samples()); n != 8 {
+		t.Fatalf("expected original to have 8 samples, got %d", n)
+	}
+
+	// Mutating the clone's configuration leaves the original untouched
+	clone.SetLeakThreshold(1)
+	if clone.LeakMetric != MetricHeapObjects || p.LeakThresholdBytesPerSec != 5<<20 {
+		t.Fatalf("configuration not copied independently: clone=%v original=%d", clone.LeakMetric, p.LeakThresholdBytesPerSec)
+	}
+
+	clone.GetMemoryStats()
+	if first := p.Samples()[0].Stats.Alloc; first != 10<<20 {
+		t.Fatalf("clone sampling affected the original: first Alloc %d", first)
+	}
+}
+
+var retained [][]byte
+
+//go:noinline
+func retainAllocations() {
+	for i := 0; i < 32; i++ {
+		retained = append(retained, make([]byte, 1<<20))
+	}
+}
+
+var (
+	leakedMu sync.Mutex
+	leaked   [][]byte
+)
+
+// RunLeakingWorkload retains rate bytes per second in the package-global
+// leaked slice until ctx is cancelled
+func RunLeakingWorkload(ctx context.Context, rate int) {
+	const tick = 10 * time.Millisecond
+	chunk := rate / int(time.Second/tick)
+
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			leakedMu.Lock()
+			leaked = append(leaked, make([]byte, chunk))
+			leakedMu.Unlock()
+		}
+	}
+}
+
+func TestLeakDetectionIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs a real leaking workload")
+	}
+	defer func() {
+		leakedMu.Lock()
+		leaked = nil
+		leakedMu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	workloadDone := make(chan struct{})
+	go func() {
+		RunLeakingWorkload(ctx, 16<<20)
+		close(workloadDone)
+	}()
+	defer func() {
+		cancel()
+		<-workloadDone
+	}()
+
+	// DetectMemoryLeaks measures its five-sample window in whole seconds
+	p := NewGoMemoryProfiler(100)
+	p.StartSamplingContext(ctx, 500*time.Millisecond)
+	defer p.StopSampling()
+
+	for {
+		if result := p.DetectMemoryLeaks(); result.IsLeakDetected {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("leak never detected, last result %+v", p.DetectMemoryLeaks())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func TestWriteFlamegraphHTML(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	retainAllocations()
+	defer func() { retained = nil }()
+	runtime.GC()
+	runtime.GC()
+
+	var buf bytes.Buffer
+	if err := p.WriteFlamegraphHTML(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	html := buf.String()
+	if !strings.Contains(html, `<div id="flamegraph">`) {
+		t.Fatal("expected the flamegraph container element")
+	}
+	if !strings.Contains(html, "retainAllocations") {
+		t.Fatal("expected the retainAllocations frame in the embedded stacks")
+	}
+}
+
+var smallObjects []*[32]byte
+
+//go:noinline
+func retainSmallObjects(n int) {
+	for i := 0; i < n; i++ {
+		smallObjects = append(smallObjects, new([32]byte))
+	}
+}
+
+func TestSetAllocSampleRate(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	original := p.AllocSampleRate()
+	defer p.SetAllocSampleRate(original)
+
+	p.SetAllocSampleRate(1)
+	if got := p.AllocSampleRate(); got != 1 {
+		t.Fatalf("expected rate 1, got %d", got)
+	}
+
+	retainSmallObjects(20000)
+	defer func() { smallObjects = nil }()
+	runtime.GC()
+	runtime.GC()
+
+	for _, site := range p.TopAllocators(50) {
+		if strings.HasSuffix(site.Function, ".retainSmallObjects") {
+			if site.InUseObjects < 20000 {
+				t.Fatalf("expected every small object to be sampled, got %d", site.InUseObjects)
+			}
+			return
+		}
+	}
+	t.Fatal("retainSmallObjects not among top allocators")
+}
+
+func TestTopAllocators(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	retainAllocations()
+	defer func() { retained = nil }()
+
+	// Heap profile data is published at the end of a GC cycle
+	runtime.GC()
+	runtime.GC()
+
+	sites := p.TopAllocators(10)
+	if len(sites) == 0 || len(sites) > 10 {
+		t.Fatalf("expected 1-10 allocation sites, got %d", len(sites))
+	}
+	for i := 1; i < len(sites); i++ {
+		if sites[i].InUseBytes > sites[i-1].InUseBytes {
+			t.Fatal("allocation sites are not sorted by in-use bytes")
+		}
+	}
+
+	found := false
+	for _, site := range sites {
+		if strings.HasSuffix(site.Function, ".retainAllocations") {
+			found = true
+			if site.InUseBytes < 16<<20 || site.Line == 0 || site.File == "" {
+				t.Fatalf("unexpected site for retainAllocations: %+v", site)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("retainAllocations not among top allocators: %+v", sites)
+	}
+}
+
+func TestWriteAllocProfileProto(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	var buf bytes.Buffer
+	if err := p.WriteAllocProfileProto(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		t.Fatalf("expected gzip-compressed pprof profile, got %d bytes", len(data))
+	}
+
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payload) == 0 {
+		t.Fatal("expected a non-empty profile.proto payload")
+	}
+}
+
+func TestWriteBlockProfile(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	p.EnableBlockProfile(1)
+	defer p.EnableBlockProfile(0)
+
+	ch := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		<-ch
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(ch)
+	<-done
+
+	path := filepath.Join(t.TempDir(), "block.pprof")
+	if err := p.WriteBlockProfile(path); err != nil {
+		t.Fatal(err)
+	}
+	assertPprofFile(t, path)
+}
+
+func TestWriteMutexProfile(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	previous := p.EnableMutexProfile(1)
+	defer p.EnableMutexProfile(previous)
+
+	path := filepath.Join(t.TempDir(), "mutex.pprof")
+	if err := p.WriteMutexProfile(path); err != nil {
+		t.Fatal(err)
+	}
+	assertPprofFile(t, path)
+}
+
+func TestConfidenceFromFit(t *testing.T) {
+	// Clean linear climb: low magnitude, high confidence
+	steady := NewGoMemoryProfiler(100)
+	addSamples(steady, linearSeries(5, 1000, 10<<20, 1<<19)...)
+
+	result := steady.DetectMemoryLeaks()
+	if result.Confidence < 99 {
+		t.Fatalf("expected high confidence for a steady climb, got %v", result.Confidence)
+	}
+	if result.Magnitude != 50 {
+		t.Fatalf("expected magnitude 50, got %v", result.Magnitude)
+	}
+
+	// Single large jump at the end: high magnitude, low confidence
+	spike := NewGoMemoryProfiler(100)
+	stats := linearSeries(5, 1000, 10<<20, 0)
+	stats[4].HeapInuse += 40 << 20
+	addSamples(spike, stats...)
+
+	result = spike.DetectMemoryLeaks()
+	if result.Magnitude < 500 {
+		t.Fatalf("expected large magnitude for a spike, got %v", result.Magnitude)
+	}
+	if result.Confidence > 60 {
+		t.Fatalf("expected low confidence for a spike, got %v", result.Confidence)
+	}
+}
+
+func TestGCEvents(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+	p.GetMemoryStats()
+	if n := len(p.GCEvents()); n != 0 {
+		t.Fatalf("expected no events before any GC, got %d", n)
+	}
+
+	runtime.GC()
+	runtime.GC()
+	p.GetMemoryStats()
+
+	events := p.GCEvents()
+	if len(events) != 2 {
+		t.Fatalf("expected 2 GC events, got %d", len(events))
+	}
+	if events[1].NumGC != events[0].NumGC+1 {
+		t.Fatalf("expected consecutive cycles, got %d and %d", events[0].NumGC, events[1].NumGC)
+	}
+	for i, event := range events {
+		if event.PauseNs == 0 || event.Time == 0 || event.HeapAfterGC == 0 {
+			t.Fatalf("event %d is incomplete: %+v", i, event)
+		}
+	}
+}
+
+func TestAddSyntheticSample(t *testing.T) {
+	p := NewGoMemoryProfiler(100)
+
+	var alerts int
+	p.OnLeakDetected(func(LeakDetectionResult) { alerts++ })
+
+	start := time.Now()
+	for _, stats := range linearSeries(10, 1000, 10<<20, 8<<20) {
+		p.AddSyntheticSample(stats)
+	}
+
+	result := p.DetectMemoryLeaks()
+	if !result.IsLeakDetected || result.GrowthRateMBPerSec != 8 {
+		t.Fatalf("expected an 8MB/sec leak verdict, got %+v", result)
+	}
+	if alerts != 1 {
+		t.Fatalf("expected synthetic samples to drive the leak callback once, got %d", alerts)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("synthetic samples should not wait on real time, took %v", elapsed)
+	}
+
+	samples := p.Samples()
+	if samples[1].Stats.Time == "" || samples[1].SmoothedAlloc == 0 {
+		t.Fatalf("synthetic samples should be recorded like real ones: %+v", samples[1])
+	}
+}
+
+// fakeClock is a Clock whose time only advances when Sleep is called
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestFakeClock(t *testing.T) {
+	clock := newFakeClock()
+	p := NewGoMemoryProfiler(100)
+	p.SetClock(clock)
+
+	if stats := p.GetMemoryStats(); stats.Timestamp != clock.Now().UnixMilli() {
+		t.Fatalf("expected timestamp from the fake clock, got %d", stats.Timestamp)
+	}
+
+	p.Reset()
+	for i := 0; i < 5; i++ {
+		p.AddSyntheticSample(MemoryStats{HeapInuse: 10<<20 + uint64(i)*(3<<20)})
+		clock.Sleep(2 * time.Second)
+	}
+
+	result := p.DetectMemoryLeaks()
+	if result.DurationSeconds != 8 {
+		t.Fatalf("expected an 8 second window, got %d", result.DurationSeconds)
+	}
+	if result.GrowthRateMBPerSec != 1.5 {
+		t.Fatalf("expected 1.5MB/sec growth, got %v", result.GrowthRateMBPerSec)
+	}
+}
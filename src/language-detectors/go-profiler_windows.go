@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+var procGetProcessMemoryInfo = syscall.NewLazyDLL("psapi.dll").NewProc("GetProcessMemoryInfo")
+
+// processMemoryCounters mirrors PROCESS_MEMORY_COUNTERS from psapi.h
+type processMemoryCounters struct {
+	CB                         uint32
+	PageFaultCount             uint32
+	PeakWorkingSetSize         uintptr
+	WorkingSetSize             uintptr
+	QuotaPeakPagedPoolUsage    uintptr
+	QuotaPagedPoolUsage        uintptr
+	QuotaPeakNonPagedPoolUsage uintptr
+	QuotaNonPagedPoolUsage     uintptr
+	PagefileUsage              uintptr
+	PeakPagefileUsage          uintptr
+}
+
+// ProcessRSS returns the working set size of the current process as seen by
+// the OS, via GetProcessMemoryInfo
+func ProcessRSS() (uint64, error) {
+	process, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0, fmt.Errorf("get current process: %w", err)
+	}
+
+	var counters processMemoryCounters
+	counters.CB = uint32(unsafe.Sizeof(counters))
+	ret, _, err := procGetProcessMemoryInfo.Call(
+		uintptr(process),
+		uintptr(unsafe.Pointer(&counters)),
+		uintptr(counters.CB),
+	)
+	if ret == 0 {
+		return 0, fmt.Errorf("GetProcessMemoryInfo: %w", err)
+	}
+	return uint64(counters.WorkingSetSize), nil
+}